@@ -0,0 +1,661 @@
+package web
+
+import (
+    "bytes"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/asn1"
+    "encoding/base64"
+    "encoding/json"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "math/big"
+    "net"
+    "net/http"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "time"
+)
+
+// LetsEncryptURL is the ACME directory used by RunAutoTLS by default.
+const LetsEncryptURL = "https://acme-v02.api.letsencrypt.org/directory"
+
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+// the protocol name and certificate extension of the tls-alpn-01 challenge (RFC 8737)
+const acmeALPNProto = "acme-tls/1"
+
+var idPeACMEIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// RunAutoTLS starts the web application and serves HTTPS requests for s,
+// using certificates for domains that are obtained and renewed
+// automatically from an ACME certificate authority such as Let's Encrypt.
+// Certificates and the account key are cached in Config.ACMECacheDir.
+// An HTTP listener on Config.AutoTLSHTTPAddr answers http-01 challenges
+// and redirects every other request to HTTPS.
+func (s *Server) RunAutoTLS(domains ...string) error {
+    s.initServer()
+    m, err := s.newAutoCert(domains)
+    if err != nil {
+        s.Logger.Println("AutoTLS error: ", err)
+        return err
+    }
+    s.acme = m
+
+    tlsAddr := s.Config.AutoTLSAddr
+    if tlsAddr == "" {
+        tlsAddr = ":443"
+    }
+    httpAddr := s.Config.AutoTLSHTTPAddr
+    if httpAddr == "" {
+        httpAddr = ":80"
+    }
+    config, err := s.clientAuthConfig(&tls.Config{
+        GetCertificate: m.GetCertificate,
+        NextProtos:     []string{"http/1.1", acmeALPNProto},
+    })
+    if err != nil {
+        s.Logger.Println("AutoTLS error: ", err)
+        return err
+    }
+    l, err := s.listen("tcp", tlsAddr)
+    if err != nil {
+        s.Logger.Println("AutoTLS listen error: ", err)
+        return err
+    }
+
+    if httpAddr != "-" {
+        //the HTTP listener accepts the PROXY protocol like the TLS one
+        hl, err := s.listen("tcp", httpAddr)
+        if err != nil {
+            l.Close()
+            s.Logger.Println("AutoTLS listen error: ", err)
+            return err
+        }
+        _, tlsPort, _ := net.SplitHostPort(tlsAddr)
+        go func() {
+            err := s.serveHTTP(hl, s.httpsRedirect(tlsPort))
+            s.Logger.Println("AutoTLS HTTP listener stopped: ", err)
+        }()
+    }
+    s.l = tls.NewListener(l, config)
+    go m.renewLoop()
+
+    s.Logger.Printf("web.go serving autotls %s\n", tlsAddr)
+    return s.serveHTTP(s.l, s)
+}
+
+// RunAutoTLS starts the web application and serves HTTPS requests for the
+// main server, with certificates for domains obtained automatically.
+func RunAutoTLS(domains ...string) error {
+    return mainServer.RunAutoTLS(domains...)
+}
+
+// httpsRedirect returns the handler of the plain HTTP listener used by
+// RunAutoTLS. ACME challenges go through the router; everything else is
+// redirected to HTTPS.
+func (s *Server) httpsRedirect(tlsPort string) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+        if strings.HasPrefix(req.URL.Path, acmeChallengePath) {
+            s.ServeHTTP(w, req)
+            return
+        }
+        host := req.Host
+        if h, _, err := net.SplitHostPort(host); err == nil {
+            host = h
+        }
+        if tlsPort != "" && tlsPort != "443" {
+            host = net.JoinHostPort(host, tlsPort)
+        }
+        status := 301
+        if req.Method != "GET" && req.Method != "HEAD" {
+            status = 308
+        }
+        http.Redirect(w, req, "https://"+host+req.URL.RequestURI(), status)
+    })
+}
+
+// serveACMEChallenge answers http-01 challenges for the certificates
+// managed by RunAutoTLS. It returns false if the request isn't one.
+func (s *Server) serveACMEChallenge(ctx *Context) bool {
+    if s.acme == nil || !strings.HasPrefix(ctx.Request.URL.Path, acmeChallengePath) {
+        return false
+    }
+    s.acme.mu.Lock()
+    keyAuth, ok := s.acme.tokens[ctx.Request.URL.Path[len(acmeChallengePath):]]
+    s.acme.mu.Unlock()
+    if !ok {
+        ctx.Abort(404, "Page not found")
+        return true
+    }
+    ctx.SetHeader("Content-Type", "text/plain", true)
+    ctx.WriteString(keyAuth)
+    return true
+}
+
+// autoCert obtains, caches and renews a certificate for a set of domains.
+type autoCert struct {
+    s         *Server
+    domains   []string
+    cacheDir  string
+    directory string
+    email     string
+    challenge string
+    client    *http.Client
+
+    mu        sync.Mutex
+    cert      *tls.Certificate
+    issued    time.Time
+    tokens    map[string]string           //http-01 token -> key authorization
+    alpnCerts map[string]*tls.Certificate //domain -> tls-alpn-01 certificate
+}
+
+func (s *Server) newAutoCert(domains []string) (*autoCert, error) {
+    if len(domains) == 0 {
+        return nil, errors.New("no domains given")
+    }
+    m := &autoCert{
+        s:         s,
+        domains:   domains,
+        cacheDir:  s.Config.ACMECacheDir,
+        directory: s.Config.ACMEDirectory,
+        email:     s.Config.ACMEEmail,
+        challenge: s.Config.ACMEChallenge,
+        client:    &http.Client{Timeout: 30 * time.Second},
+        tokens:    map[string]string{},
+        alpnCerts: map[string]*tls.Certificate{},
+    }
+    if m.cacheDir == "" {
+        m.cacheDir = "acme-cache"
+    }
+    if m.directory == "" {
+        m.directory = LetsEncryptURL
+    }
+    if m.challenge == "" {
+        m.challenge = "http-01"
+    }
+    if m.challenge != "http-01" && m.challenge != "tls-alpn-01" {
+        return nil, fmt.Errorf("unsupported ACME challenge %q", m.challenge)
+    }
+    if err := os.MkdirAll(m.cacheDir, 0700); err != nil {
+        return nil, err
+    }
+    if cert, err := m.loadCached(); err == nil {
+        m.cert = cert
+    }
+    return m, nil
+}
+
+// GetCertificate returns the managed certificate, or a tls-alpn-01
+// challenge certificate during validation.
+func (m *autoCert) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    for _, proto := range hello.SupportedProtos {
+        if proto == acmeALPNProto {
+            if cert, ok := m.alpnCerts[strings.ToLower(hello.ServerName)]; ok {
+                return cert, nil
+            }
+            return nil, errors.New("no tls-alpn-01 challenge for " + hello.ServerName)
+        }
+    }
+    if m.cert == nil {
+        return nil, errors.New("certificate not available yet")
+    }
+    return m.cert, nil
+}
+
+func (m *autoCert) cacheFile() string {
+    return filepath.Join(m.cacheDir, m.domains[0]+".pem")
+}
+
+// loadCached loads the cached certificate if it covers every domain and
+// isn't about to expire.
+func (m *autoCert) loadCached() (*tls.Certificate, error) {
+    data, err := ioutil.ReadFile(m.cacheFile())
+    if err != nil {
+        return nil, err
+    }
+    cert, err := tls.X509KeyPair(data, data)
+    if err != nil {
+        return nil, err
+    }
+    if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+        return nil, err
+    }
+    for _, d := range m.domains {
+        if err := cert.Leaf.VerifyHostname(d); err != nil {
+            return nil, err
+        }
+    }
+    if time.Now().After(renewalTime(cert.Leaf)) {
+        return nil, errors.New("cached certificate expires soon")
+    }
+    return &cert, nil
+}
+
+// minRenewInterval is the least time between two certificate requests,
+// so that a CA issuing very short-lived certificates isn't flooded.
+const minRenewInterval = 10 * time.Minute
+
+// renewalTime returns when cert should be renewed: when a third of its
+// lifetime remains, but at most 30 days before it expires.
+func renewalTime(cert *x509.Certificate) time.Time {
+    before := cert.NotAfter.Sub(cert.NotBefore) / 3
+    if before > 30*24*time.Hour {
+        before = 30 * 24 * time.Hour
+    }
+    return cert.NotAfter.Add(-before)
+}
+
+// renewLoop obtains the certificate if there is none, and renews it
+// before it expires.
+func (m *autoCert) renewLoop() {
+    for {
+        m.mu.Lock()
+        cert, issued := m.cert, m.issued
+        m.mu.Unlock()
+
+        wait := time.Duration(0)
+        if cert != nil {
+            wait = time.Until(renewalTime(cert.Leaf))
+        }
+        if next := minRenewInterval - time.Since(issued); next > wait {
+            wait = next
+        }
+        if wait > 0 {
+            if wait > 12*time.Hour {
+                wait = 12 * time.Hour
+            }
+            time.Sleep(wait)
+            continue
+        }
+        if err := m.obtain(); err != nil {
+            m.s.Logger.Println("ACME certificate request failed: ", err)
+            time.Sleep(time.Hour)
+        }
+    }
+}
+
+// obtain requests a new certificate from the ACME server and caches it.
+func (m *autoCert) obtain() error {
+    c, err := m.newClient()
+    if err != nil {
+        return err
+    }
+    var identifiers []map[string]string
+    for _, d := range m.domains {
+        identifiers = append(identifiers, map[string]string{"type": "dns", "value": d})
+    }
+    var order acmeOrder
+    resp, err := c.post(c.dir.NewOrder, map[string]interface{}{"identifiers": identifiers}, &order)
+    if err != nil {
+        return err
+    }
+    orderURL := resp.Header.Get("Location")
+
+    for _, authzURL := range order.Authorizations {
+        if err := m.authorize(c, authzURL); err != nil {
+            return err
+        }
+    }
+
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        return err
+    }
+    csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+        Subject:  pkix.Name{CommonName: m.domains[0]},
+        DNSNames: m.domains,
+    }, key)
+    if err != nil {
+        return err
+    }
+    if _, err := c.post(order.Finalize, map[string]string{"csr": base64.RawURLEncoding.EncodeToString(csr)}, &order); err != nil {
+        return err
+    }
+    for i := 0; order.Status != "valid"; i++ {
+        if order.Status == "invalid" || i == 30 {
+            return fmt.Errorf("order %s is %s", orderURL, order.Status)
+        }
+        time.Sleep(c.pollInterval)
+        if _, err := c.post(orderURL, nil, &order); err != nil {
+            return err
+        }
+    }
+
+    resp, err = c.post(order.Certificate, nil, nil)
+    if err != nil {
+        return err
+    }
+    chain, err := ioutil.ReadAll(resp.Body)
+    resp.Body.Close()
+    if err != nil {
+        return err
+    }
+    keyDER, err := x509.MarshalECPrivateKey(key)
+    if err != nil {
+        return err
+    }
+    data := append(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), chain...)
+    cert, err := tls.X509KeyPair(data, data)
+    if err != nil {
+        return err
+    }
+    if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+        return err
+    }
+    if err := ioutil.WriteFile(m.cacheFile(), data, 0600); err != nil {
+        m.s.Logger.Println("Error caching certificate: ", err)
+    }
+
+    m.mu.Lock()
+    m.cert = &cert
+    m.issued = time.Now()
+    m.mu.Unlock()
+    m.s.Logger.Printf("Obtained certificate for %s, valid until %s\n", strings.Join(m.domains, ", "), cert.Leaf.NotAfter.Format(time.RFC1123))
+    return nil
+}
+
+// authorize completes the configured challenge of an authorization.
+func (m *autoCert) authorize(c *acmeClient, authzURL string) error {
+    var authz acmeAuthorization
+    if _, err := c.post(authzURL, nil, &authz); err != nil {
+        return err
+    }
+    if authz.Status == "valid" {
+        return nil
+    }
+    var chal *acmeChallenge
+    for i := range authz.Challenges {
+        if authz.Challenges[i].Type == m.challenge {
+            chal = &authz.Challenges[i]
+        }
+    }
+    if chal == nil {
+        return fmt.Errorf("no %s challenge offered for %s", m.challenge, authz.Identifier.Value)
+    }
+    keyAuth := chal.Token + "." + c.thumbprint()
+    domain := strings.ToLower(authz.Identifier.Value)
+
+    m.mu.Lock()
+    if m.challenge == "http-01" {
+        m.tokens[chal.Token] = keyAuth
+    } else {
+        cert, err := alpnChallengeCert(domain, keyAuth)
+        if err != nil {
+            m.mu.Unlock()
+            return err
+        }
+        m.alpnCerts[domain] = cert
+    }
+    m.mu.Unlock()
+    defer func() {
+        m.mu.Lock()
+        delete(m.tokens, chal.Token)
+        delete(m.alpnCerts, domain)
+        m.mu.Unlock()
+    }()
+
+    resp, err := c.post(chal.URL, struct{}{}, nil)
+    if err != nil {
+        return err
+    }
+    resp.Body.Close()
+    for i := 0; ; i++ {
+        time.Sleep(c.pollInterval)
+        if _, err := c.post(authzURL, nil, &authz); err != nil {
+            return err
+        }
+        switch {
+        case authz.Status == "valid":
+            return nil
+        case authz.Status != "pending" && authz.Status != "processing", i == 30:
+            return fmt.Errorf("authorization for %s is %s", domain, authz.Status)
+        }
+    }
+}
+
+// alpnChallengeCert returns the self-signed certificate that answers a
+// tls-alpn-01 challenge.
+func alpnChallengeCert(domain string, keyAuth string) (*tls.Certificate, error) {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        return nil, err
+    }
+    digest := sha256.Sum256([]byte(keyAuth))
+    ext, err := asn1.Marshal(digest[:])
+    if err != nil {
+        return nil, err
+    }
+    tmpl := &x509.Certificate{
+        SerialNumber:    big.NewInt(1),
+        Subject:         pkix.Name{CommonName: domain},
+        DNSNames:        []string{domain},
+        NotBefore:       time.Now().Add(-time.Hour),
+        NotAfter:        time.Now().Add(24 * time.Hour),
+        ExtraExtensions: []pkix.Extension{{Id: idPeACMEIdentifier, Critical: true, Value: ext}},
+    }
+    der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+    if err != nil {
+        return nil, err
+    }
+    return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+type acmeDirectory struct {
+    NewNonce   string `json:"newNonce"`
+    NewAccount string `json:"newAccount"`
+    NewOrder   string `json:"newOrder"`
+}
+
+type acmeOrder struct {
+    Status         string   `json:"status"`
+    Authorizations []string `json:"authorizations"`
+    Finalize       string   `json:"finalize"`
+    Certificate    string   `json:"certificate"`
+}
+
+type acmeAuthorization struct {
+    Status     string `json:"status"`
+    Identifier struct {
+        Value string `json:"value"`
+    } `json:"identifier"`
+    Challenges []acmeChallenge `json:"challenges"`
+}
+
+type acmeChallenge struct {
+    Type   string `json:"type"`
+    URL    string `json:"url"`
+    Token  string `json:"token"`
+    Status string `json:"status"`
+}
+
+type acmeProblem struct {
+    Type   string `json:"type"`
+    Detail string `json:"detail"`
+}
+
+func (p *acmeProblem) Error() string {
+    return "acme: " + p.Type + ": " + p.Detail
+}
+
+// acmeClient speaks the ACME protocol (RFC 8555) with an account key.
+type acmeClient struct {
+    http         *http.Client
+    dir          acmeDirectory
+    key          *ecdsa.PrivateKey
+    kid          string
+    nonce        string
+    pollInterval time.Duration
+}
+
+// newClient fetches the directory and registers the account, creating
+// and caching an account key if there is none.
+func (m *autoCert) newClient() (*acmeClient, error) {
+    c := &acmeClient{http: m.client, pollInterval: time.Second}
+    if m.s.Config.ACMEPollInterval > 0 {
+        c.pollInterval = m.s.Config.ACMEPollInterval
+    }
+    resp, err := c.http.Get(m.directory)
+    if err != nil {
+        return nil, err
+    }
+    err = json.NewDecoder(resp.Body).Decode(&c.dir)
+    resp.Body.Close()
+    if err != nil {
+        return nil, err
+    }
+
+    keyFile := filepath.Join(m.cacheDir, "acme_account.key")
+    if data, err := ioutil.ReadFile(keyFile); err == nil {
+        if block, _ := pem.Decode(data); block != nil {
+            c.key, _ = x509.ParseECPrivateKey(block.Bytes)
+        }
+    }
+    if c.key == nil {
+        if c.key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+            return nil, err
+        }
+        der, _ := x509.MarshalECPrivateKey(c.key)
+        if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+            m.s.Logger.Println("Error caching ACME account key: ", err)
+        }
+    }
+
+    account := map[string]interface{}{"termsOfServiceAgreed": true}
+    if m.email != "" {
+        account["contact"] = []string{"mailto:" + m.email}
+    }
+    resp, err = c.post(c.dir.NewAccount, account, nil)
+    if err != nil {
+        return nil, err
+    }
+    resp.Body.Close()
+    c.kid = resp.Header.Get("Location")
+    if c.kid == "" {
+        return nil, errors.New("acme: account has no URL")
+    }
+    return c, nil
+}
+
+func (c *acmeClient) jwk() map[string]string {
+    x, y := make([]byte, 32), make([]byte, 32)
+    c.key.X.FillBytes(x)
+    c.key.Y.FillBytes(y)
+    return map[string]string{
+        "crv": "P-256",
+        "kty": "EC",
+        "x":   base64.RawURLEncoding.EncodeToString(x),
+        "y":   base64.RawURLEncoding.EncodeToString(y),
+    }
+}
+
+// thumbprint returns the JWK thumbprint (RFC 7638) of the account key.
+func (c *acmeClient) thumbprint() string {
+    jwk := c.jwk()
+    // members in lexicographic order, without whitespace
+    data := `{"crv":"` + jwk["crv"] + `","kty":"` + jwk["kty"] + `","x":"` + jwk["x"] + `","y":"` + jwk["y"] + `"}`
+    digest := sha256.Sum256([]byte(data))
+    return base64.RawURLEncoding.EncodeToString(digest[:])
+}
+
+func (c *acmeClient) getNonce() (string, error) {
+    if c.nonce != "" {
+        n := c.nonce
+        c.nonce = ""
+        return n, nil
+    }
+    resp, err := c.http.Head(c.dir.NewNonce)
+    if err != nil {
+        return "", err
+    }
+    resp.Body.Close()
+    if n := resp.Header.Get("Replay-Nonce"); n != "" {
+        return n, nil
+    }
+    return "", errors.New("acme: no nonce")
+}
+
+// post sends a JWS signed request. A nil payload sends a POST-as-GET.
+// If out is not nil the response body is decoded into it, otherwise the
+// caller must close the body.
+func (c *acmeClient) post(url string, payload interface{}, out interface{}) (*http.Response, error) {
+    for retry := 0; ; retry++ {
+        resp, err := c.postOnce(url, payload)
+        if err != nil {
+            return nil, err
+        }
+        if n := resp.Header.Get("Replay-Nonce"); n != "" {
+            c.nonce = n
+        }
+        if resp.StatusCode >= 400 {
+            problem := &acmeProblem{}
+            json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(problem)
+            resp.Body.Close()
+            if problem.Type == "urn:ietf:params:acme:error:badNonce" && retry < 3 {
+                continue
+            }
+            if problem.Type == "" {
+                problem.Type = resp.Status
+            }
+            return nil, problem
+        }
+        if out != nil {
+            err = json.NewDecoder(resp.Body).Decode(out)
+            resp.Body.Close()
+            if err != nil {
+                return nil, err
+            }
+        }
+        return resp, nil
+    }
+}
+
+func (c *acmeClient) postOnce(url string, payload interface{}) (*http.Response, error) {
+    nonce, err := c.getNonce()
+    if err != nil {
+        return nil, err
+    }
+    protected := map[string]interface{}{"alg": "ES256", "nonce": nonce, "url": url}
+    if c.kid != "" {
+        protected["kid"] = c.kid
+    } else {
+        protected["jwk"] = c.jwk()
+    }
+    ph, err := json.Marshal(protected)
+    if err != nil {
+        return nil, err
+    }
+    var pl []byte
+    if payload != nil {
+        if pl, err = json.Marshal(payload); err != nil {
+            return nil, err
+        }
+    }
+    b64 := base64.RawURLEncoding.EncodeToString
+    signed := b64(ph) + "." + b64(pl)
+    digest := sha256.Sum256([]byte(signed))
+    r, s, err := ecdsa.Sign(rand.Reader, c.key, digest[:])
+    if err != nil {
+        return nil, err
+    }
+    sig := make([]byte, 64)
+    r.FillBytes(sig[:32])
+    s.FillBytes(sig[32:])
+    body, err := json.Marshal(map[string]string{"protected": b64(ph), "payload": b64(pl), "signature": b64(sig)})
+    if err != nil {
+        return nil, err
+    }
+    return c.http.Post(url, "application/jose+json", bytes.NewReader(body))
+}
@@ -0,0 +1,153 @@
+package web
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "io"
+    "io/fs"
+    "path"
+    "strings"
+    "sync"
+)
+
+// immutableCacheControl is sent for fingerprinted asset URLs, whose
+// content never changes.
+const immutableCacheControl = "public, max-age=31536000, immutable"
+
+// A cacheRule sets the Cache-Control header of the static files that
+// match a URL prefix or an extension pattern.
+type cacheRule struct {
+    match        string
+    cacheControl string
+}
+
+// CacheControl sets the Cache-Control header of static files that match.
+// A match of the form "*.css" matches by extension, anything else is a
+// URL prefix such as "/assets/". Rules are checked in the order they were
+// added and the first match applies.
+func (s *Server) CacheControl(match string, cacheControl string) {
+    s.cacheRules = append(s.cacheRules, cacheRule{match, cacheControl})
+}
+
+// cacheControl returns the Cache-Control header for the static file at
+// urlPath, or "" if no rule matches.
+func (s *Server) cacheControl(urlPath string) string {
+    for _, rule := range s.cacheRules {
+        if strings.HasPrefix(rule.match, "*.") {
+            if path.Ext(urlPath) == rule.match[1:] {
+                return rule.cacheControl
+            }
+        } else if strings.HasPrefix(urlPath, rule.match) {
+            return rule.cacheControl
+        }
+    }
+    return ""
+}
+
+// assetMap maps the URLs of static files to their fingerprinted URLs and
+// back.
+type assetMap struct {
+    mu       sync.RWMutex
+    hashed   map[string]string
+    original map[string]string
+}
+
+// Fingerprint computes the content hashes of all static files, so that
+// AssetURL can rewrite /app.js to /app.3f9a1c2b.js. The fingerprinted URLs
+// are served with immutable caching. Call it at startup, after mounting
+// the static directories, and again if the files change.
+func (s *Server) Fingerprint() error {
+    hashed := map[string]string{}
+    add := func(fsys fs.FS, prefix string) error {
+        return fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+            if err != nil || d.IsDir() {
+                return err
+            }
+            if s.staticDenied(name) {
+                return nil
+            }
+            urlPath := prefix + "/" + name
+            if _, ok := hashed[urlPath]; ok {
+                //a file of a layer with a higher priority
+                return nil
+            }
+            sum, err := hashFile(fsys, name)
+            if err != nil {
+                return err
+            }
+            hashed[urlPath] = fingerprintPath(urlPath, sum)
+            return nil
+        })
+    }
+    for _, m := range s.mounts {
+        if err := add(m.fsys, m.prefix); err != nil {
+            return err
+        }
+    }
+    for _, fsys := range s.staticFS() {
+        //the default directories usually don't exist
+        if err := add(fsys, ""); err != nil && !errors.Is(err, fs.ErrNotExist) {
+            return err
+        }
+    }
+
+    original := map[string]string{}
+    for k, v := range hashed {
+        original[v] = k
+    }
+    s.assets.mu.Lock()
+    s.assets.hashed, s.assets.original = hashed, original
+    s.assets.mu.Unlock()
+    return nil
+}
+
+func hashFile(fsys fs.FS, name string) (string, error) {
+    f, err := fsys.Open(name)
+    if err != nil {
+        return "", err
+    }
+    defer f.Close()
+    h := sha256.New()
+    if _, err := io.Copy(h, f); err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(h.Sum(nil))[:8], nil
+}
+
+// fingerprintPath inserts sum before the extension of urlPath.
+func fingerprintPath(urlPath string, sum string) string {
+    ext := path.Ext(urlPath)
+    if path.Base(urlPath) == ext {
+        //a dotfile such as /.htaccess
+        ext = ""
+    }
+    return urlPath[:len(urlPath)-len(ext)] + "." + sum + ext
+}
+
+// AssetURL returns the fingerprinted URL of the static file at urlPath, or
+// urlPath if it has none.
+func (s *Server) AssetURL(urlPath string) string {
+    s.assets.mu.RLock()
+    defer s.assets.mu.RUnlock()
+    if hashed, ok := s.assets.hashed[urlPath]; ok {
+        return hashed
+    }
+    return urlPath
+}
+
+// AssetFuncs returns template functions for use with the Funcs method of
+// text/template and html/template. {{asset "/app.js"}} expands to the
+// fingerprinted URL of /app.js.
+func (s *Server) AssetFuncs() map[string]interface{} {
+    return map[string]interface{}{"asset": s.AssetURL}
+}
+
+// assetOriginal returns the URL of the static file that the fingerprinted
+// URL urlPath refers to.
+func (s *Server) assetOriginal(urlPath string) (string, bool) {
+    s.assets.mu.RLock()
+    defer s.assets.mu.RUnlock()
+    original, ok := s.assets.original[urlPath]
+    return original, ok
+}
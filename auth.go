@@ -0,0 +1,254 @@
+package web
+
+import (
+    "crypto/hmac"
+    "crypto/md5"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/base64"
+    "encoding/binary"
+    "encoding/hex"
+    "hash"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// A CredentialFunc returns the password of user, or false if there is no
+// such user. It is used by the Basic and Digest authentication middleware.
+type CredentialFunc func(user string) (password string, ok bool)
+
+// User returns the name of the user authenticated by the authentication
+// middleware, or an empty string for anonymous requests.
+func (ctx *Context) User() string {
+    return ctx.user
+}
+
+// BasicAuth returns a middleware that requires HTTP Basic authentication
+// (RFC 7617) with the given realm. Passwords are compared in constant time.
+func BasicAuth(realm string, credentials CredentialFunc) Middleware {
+    challenge := `Basic realm=` + strconv.Quote(realm) + `, charset="UTF-8"`
+    return func(ctx *Context, next func()) {
+        user, password, ok := ctx.Request.BasicAuth()
+        if ok {
+            expected, found := credentials(user)
+            // compare against something even for unknown users so that
+            // the response time doesn't reveal which users exist
+            if !found {
+                expected = password + "x"
+            }
+            if subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1 && found {
+                ctx.user = user
+                next()
+                return
+            }
+        }
+        ctx.SetHeader("WWW-Authenticate", challenge, true)
+        ctx.Abort(401, "Unauthorized")
+    }
+}
+
+// DigestAuthConfig is the configuration for the Digest authentication middleware.
+type DigestAuthConfig struct {
+    Realm       string
+    Credentials CredentialFunc
+    // Algorithms lists the supported hash algorithms in order of
+    // preference. Valid values are "SHA-256" and "MD5". Defaults to both.
+    Algorithms []string
+    // NonceLifetime is how long a nonce may be used before the client is
+    // asked to retry with a fresh one. Defaults to 5 minutes.
+    NonceLifetime time.Duration
+}
+
+type digestAuth struct {
+    config DigestAuthConfig
+    key    []byte
+    opaque string
+
+    mu     sync.Mutex
+    counts map[string]uint64 //the highest nonce count seen for each nonce
+    pruned time.Time
+}
+
+// DigestAuth returns a middleware that requires HTTP Digest authentication
+// (RFC 7616) with qop=auth. Nonces are signed by the server, expire after
+// the configured lifetime, and each nonce count is accepted only once.
+// The config is required, since it holds the credentials.
+func DigestAuth(config *DigestAuthConfig) Middleware {
+    if config == nil {
+        panic("web: DigestAuth requires a config")
+    }
+    d := &digestAuth{config: *config, counts: map[string]uint64{}}
+    if len(d.config.Algorithms) == 0 {
+        d.config.Algorithms = []string{"SHA-256", "MD5"}
+    }
+    if d.config.NonceLifetime == 0 {
+        d.config.NonceLifetime = 5 * time.Minute
+    }
+    d.key = make([]byte, 32)
+    rand.Read(d.key)
+    o := make([]byte, 16)
+    rand.Read(o)
+    d.opaque = hex.EncodeToString(o)
+    return d.handle
+}
+
+func (d *digestAuth) handle(ctx *Context, next func()) {
+    stale := false
+    auth := ctx.Request.Header.Get("Authorization")
+    if strings.HasPrefix(auth, "Digest ") {
+        var user string
+        var ok bool
+        user, stale, ok = d.verify(ctx, parseAuthParams(auth[len("Digest "):]))
+        if ok {
+            ctx.user = user
+            next()
+            return
+        }
+    }
+    nonce := d.newNonce()
+    for _, alg := range d.config.Algorithms {
+        challenge := `Digest realm=` + strconv.Quote(d.config.Realm) +
+            `, qop="auth", algorithm=` + alg +
+            `, nonce="` + nonce + `", opaque="` + d.opaque + `"`
+        if stale {
+            challenge += ", stale=true"
+        }
+        ctx.SetHeader("WWW-Authenticate", challenge, false)
+    }
+    ctx.Abort(401, "Unauthorized")
+}
+
+// newNonce returns a nonce made of the issue time, random bytes and a
+// signature over both, so that the server doesn't need to store it.
+func (d *digestAuth) newNonce() string {
+    b := make([]byte, 16, 48)
+    binary.BigEndian.PutUint64(b, uint64(time.Now().UnixNano()))
+    rand.Read(b[8:16])
+    mac := hmac.New(sha256.New, d.key)
+    mac.Write(b)
+    return base64.RawURLEncoding.EncodeToString(mac.Sum(b))
+}
+
+// checkNonce verifies the signature of a nonce and returns its issue time.
+func (d *digestAuth) checkNonce(nonce string) (time.Time, bool) {
+    b, err := base64.RawURLEncoding.DecodeString(nonce)
+    if err != nil || len(b) != 48 {
+        return time.Time{}, false
+    }
+    mac := hmac.New(sha256.New, d.key)
+    mac.Write(b[:16])
+    if !hmac.Equal(mac.Sum(nil), b[16:]) {
+        return time.Time{}, false
+    }
+    return time.Unix(0, int64(binary.BigEndian.Uint64(b))), true
+}
+
+// verify checks the digest response in params and returns the user. stale
+// is true if the response was correct but made with an expired nonce.
+func (d *digestAuth) verify(ctx *Context, params map[string]string) (user string, stale bool, ok bool) {
+    alg := params["algorithm"]
+    if alg == "" {
+        alg = "MD5"
+    }
+    var h func() hash.Hash
+    for _, a := range d.config.Algorithms {
+        if strings.EqualFold(a, alg) {
+            switch strings.ToUpper(a) {
+            case "SHA-256":
+                h = sha256.New
+            case "MD5":
+                h = md5.New
+            }
+        }
+    }
+    if h == nil || params["qop"] != "auth" || params["realm"] != d.config.Realm ||
+        params["opaque"] != d.opaque || params["uri"] != ctx.Request.URL.RequestURI() {
+        return "", false, false
+    }
+    issued, valid := d.checkNonce(params["nonce"])
+    if !valid {
+        return "", false, false
+    }
+    nc, err := strconv.ParseUint(params["nc"], 16, 64)
+    if err != nil {
+        return "", false, false
+    }
+
+    user = params["username"]
+    password, found := d.config.Credentials(user)
+    hexHash := func(s string) string {
+        hh := h()
+        hh.Write([]byte(s))
+        return hex.EncodeToString(hh.Sum(nil))
+    }
+    ha1 := hexHash(user + ":" + d.config.Realm + ":" + password)
+    ha2 := hexHash(ctx.Request.Method + ":" + params["uri"])
+    expected := hexHash(strings.Join([]string{ha1, params["nonce"], params["nc"], params["cnonce"], "auth", ha2}, ":"))
+    if subtle.ConstantTimeCompare([]byte(expected), []byte(params["response"])) != 1 || !found {
+        return "", false, false
+    }
+
+    now := time.Now()
+    if now.Sub(issued) > d.config.NonceLifetime {
+        return "", true, false
+    }
+
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    if nc <= d.counts[params["nonce"]] {
+        //replayed request
+        return "", false, false
+    }
+    d.counts[params["nonce"]] = nc
+    if now.Sub(d.pruned) > d.config.NonceLifetime {
+        d.pruned = now
+        for n := range d.counts {
+            if t, _ := d.checkNonce(n); now.Sub(t) > d.config.NonceLifetime {
+                delete(d.counts, n)
+            }
+        }
+    }
+    return user, false, true
+}
+
+// parseAuthParams parses the comma separated name=value pairs of an
+// Authorization header. Values may be quoted strings.
+func parseAuthParams(s string) map[string]string {
+    params := map[string]string{}
+    for {
+        s = strings.TrimLeft(s, " ,")
+        eq := strings.IndexByte(s, '=')
+        if eq < 0 {
+            return params
+        }
+        name := strings.ToLower(strings.TrimSpace(s[:eq]))
+        s = strings.TrimLeft(s[eq+1:], " ")
+        var value string
+        if strings.HasPrefix(s, `"`) {
+            var buf []byte
+            i := 1
+            for ; i < len(s) && s[i] != '"'; i++ {
+                if s[i] == '\\' && i+1 < len(s) {
+                    i++
+                }
+                buf = append(buf, s[i])
+            }
+            value = string(buf)
+            if i < len(s) {
+                i++
+            }
+            s = s[i:]
+        } else {
+            end := strings.IndexByte(s, ',')
+            if end < 0 {
+                end = len(s)
+            }
+            value = strings.TrimSpace(s[:end])
+            s = s[end:]
+        }
+        params[name] = value
+    }
+}
@@ -0,0 +1,177 @@
+package web
+
+import (
+    "fmt"
+    "io"
+    "strings"
+)
+
+// Access describes the requirements for invoking a route. A principal
+// satisfies it by having any one of the listed roles or permissions. An
+// Access with no roles or permissions only requires an authenticated principal.
+type Access struct {
+    Roles       []string
+    Permissions []string
+}
+
+func (a *Access) String() string {
+    var parts []string
+    for _, r := range a.Roles {
+        parts = append(parts, "role:"+r)
+    }
+    for _, p := range a.Permissions {
+        parts = append(parts, "permission:"+p)
+    }
+    if len(parts) == 0 {
+        return "authenticated"
+    }
+    return strings.Join(parts, " | ")
+}
+
+// A Principal is the authenticated identity making a request.
+type Principal struct {
+    Name        string
+    Roles       []string
+    Permissions []string
+}
+
+// A Policy decides whether principal p may invoke a route that requires
+// access. p is never nil.
+type Policy func(ctx *Context, p *Principal, access *Access) bool
+
+// DefaultPolicy allows a principal that has any of the roles or
+// permissions listed in access.
+func DefaultPolicy(ctx *Context, p *Principal, access *Access) bool {
+    if len(access.Roles) == 0 && len(access.Permissions) == 0 {
+        return true
+    }
+    for _, r := range access.Roles {
+        if containsString(p.Roles, r) {
+            return true
+        }
+    }
+    for _, perm := range access.Permissions {
+        if containsString(p.Permissions, perm) {
+            return true
+        }
+    }
+    return false
+}
+
+// SetPrincipal sets the principal of the current request. Authentication
+// middleware that knows the roles of a user should call it.
+func (ctx *Context) SetPrincipal(p *Principal) {
+    ctx.principal = p
+    if p != nil {
+        ctx.user = p.Name
+    }
+}
+
+// Principal returns the principal of the current request, or nil for
+// anonymous requests. If no principal was set but a user or a JWT was
+// authenticated, a principal is built from the user name and, for JWTs,
+// the "roles", "permissions" and "scope" claims. Tokens without a "sub"
+// claim, such as client credentials tokens, give a principal without a
+// name.
+func (ctx *Context) Principal() *Principal {
+    if ctx.principal != nil || ctx.user == "" && ctx.claims == nil {
+        return ctx.principal
+    }
+    p := &Principal{Name: ctx.user}
+    if ctx.claims != nil {
+        p.Roles = claimStrings(ctx.claims["roles"])
+        p.Permissions = claimStrings(ctx.claims["permissions"])
+        if scope := ctx.claims.String("scope"); scope != "" {
+            p.Permissions = append(p.Permissions, strings.Fields(scope)...)
+        }
+    }
+    ctx.principal = p
+    return p
+}
+
+func claimStrings(v interface{}) []string {
+    switch v := v.(type) {
+    case string:
+        return []string{v}
+    case []interface{}:
+        var list []string
+        for _, s := range v {
+            if s, ok := s.(string); ok {
+                list = append(list, s)
+            }
+        }
+        return list
+    }
+    return nil
+}
+
+func containsString(list []string, s string) bool {
+    for _, v := range list {
+        if v == s {
+            return true
+        }
+    }
+    return false
+}
+
+// authorize checks the access requirements of a route against the principal
+// of the request, which must satisfy all of them. It writes a 401 or 403
+// response and returns false if access is denied.
+func (s *Server) authorize(ctx *Context, access []*Access) bool {
+    if len(access) == 0 {
+        return true
+    }
+    p := ctx.Principal()
+    if p == nil {
+        ctx.Abort(401, "Unauthorized")
+        return false
+    }
+    policy := s.Policy
+    if policy == nil {
+        policy = DefaultPolicy
+    }
+    for _, a := range access {
+        if !policy(ctx, p, a) {
+            s.Logger.Printf("Access denied to %q for %s %s\n", p.Name, ctx.Request.Method, ctx.Request.URL.Path)
+            ctx.Abort(403, "Forbidden")
+            return false
+        }
+    }
+    return true
+}
+
+// Require returns a group whose routes may only be invoked by principals
+// that satisfy access. The requirement is checked after the route's
+// middleware has run, so authentication middleware can be part of the group.
+func (s *Server) Require(access Access) *RouteGroup {
+    return &RouteGroup{s: s, access: []*Access{&access}}
+}
+
+// Require returns a copy of group g whose routes may only be invoked by
+// principals that satisfy access as well as the requirements of g.
+func (g *RouteGroup) Require(access Access) *RouteGroup {
+    ng := g.Group("")
+    ng.access = append(append([]*Access{}, g.access...), &access)
+    return ng
+}
+
+// DumpAccess writes the access requirements of every route of server s to
+// w, one route per line, for auditing.
+func (s *Server) DumpAccess(w io.Writer) error {
+    for _, route := range s.routes {
+        req := "public"
+        if len(route.access) == 1 {
+            req = route.access[0].String()
+        } else if len(route.access) > 1 {
+            var parts []string
+            for _, a := range route.access {
+                parts = append(parts, "("+a.String()+")")
+            }
+            req = strings.Join(parts, " & ")
+        }
+        if _, err := fmt.Fprintf(w, "%-7s %-30s %s\n", route.method, route.r, req); err != nil {
+            return err
+        }
+    }
+    return nil
+}
@@ -0,0 +1,247 @@
+package web
+
+import (
+    "crypto/tls"
+    "crypto/x509"
+    "errors"
+    "log"
+    "os"
+    "os/signal"
+    "strings"
+    "sync"
+    "syscall"
+    "time"
+)
+
+// A CertManager serves TLS certificates loaded from files, and reloads them
+// when they change so that renewed certificates are used without a restart.
+// Several certificates can be added; the one to use for a connection is
+// chosen by the SNI server name. Use it with RunTLS through TLSConfig.
+type CertManager struct {
+    // ExpiryWarning is how long before expiry a certificate starts being
+    // reported in the log. Defaults to 30 days.
+    ExpiryWarning time.Duration
+    Logger        *log.Logger
+
+    mu    sync.RWMutex
+    pairs []*certPair
+    names map[string]*tls.Certificate
+
+    stop chan bool
+}
+
+type certPair struct {
+    certFile, keyFile string
+    cert              *tls.Certificate
+    certMod, keyMod   time.Time
+    warned            time.Time
+}
+
+// NewCertManager returns an empty certificate manager.
+func NewCertManager() *CertManager {
+    return &CertManager{
+        ExpiryWarning: 30 * 24 * time.Hour,
+        Logger:        log.New(os.Stdout, "", log.Ldate|log.Ltime),
+        names:         map[string]*tls.Certificate{},
+    }
+}
+
+// Add loads a PEM certificate and key pair. The first pair added is used
+// for clients that don't send a matching server name.
+func (m *CertManager) Add(certFile, keyFile string) error {
+    p := &certPair{certFile: certFile, keyFile: keyFile}
+    if err := p.load(); err != nil {
+        return err
+    }
+    m.mu.Lock()
+    m.pairs = append(m.pairs, p)
+    m.index()
+    m.mu.Unlock()
+    m.checkExpiry()
+    return nil
+}
+
+func (p *certPair) load() error {
+    certInfo, err := os.Stat(p.certFile)
+    if err != nil {
+        return err
+    }
+    keyInfo, err := os.Stat(p.keyFile)
+    if err != nil {
+        return err
+    }
+    cert, err := tls.LoadX509KeyPair(p.certFile, p.keyFile)
+    if err != nil {
+        return err
+    }
+    if cert.Leaf == nil {
+        if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+            return err
+        }
+    }
+    p.cert = &cert
+    p.certMod = certInfo.ModTime()
+    p.keyMod = keyInfo.ModTime()
+    return nil
+}
+
+// changed reports whether the files of p were modified since they were loaded.
+func (p *certPair) changed() bool {
+    certInfo, err1 := os.Stat(p.certFile)
+    keyInfo, err2 := os.Stat(p.keyFile)
+    if err1 != nil || err2 != nil {
+        return false
+    }
+    return !certInfo.ModTime().Equal(p.certMod) || !keyInfo.ModTime().Equal(p.keyMod)
+}
+
+// index rebuilds the server name lookup table. m.mu must be held.
+func (m *CertManager) index() {
+    names := map[string]*tls.Certificate{}
+    for _, p := range m.pairs {
+        leaf := p.cert.Leaf
+        for _, name := range append([]string{leaf.Subject.CommonName}, leaf.DNSNames...) {
+            name = strings.ToLower(name)
+            if _, ok := names[name]; name != "" && !ok {
+                names[name] = p.cert
+            }
+        }
+    }
+    m.names = names
+}
+
+// Reload reloads every certificate whose files changed. A pair that fails
+// to load keeps being served with its previous certificate.
+func (m *CertManager) Reload() error {
+    return m.reload(false)
+}
+
+func (m *CertManager) reload(all bool) error {
+    m.mu.RLock()
+    pairs := m.pairs
+    m.mu.RUnlock()
+
+    var firstErr error
+    var updated []*certPair
+    for _, p := range pairs {
+        if !all && !p.changed() {
+            continue
+        }
+        np := &certPair{certFile: p.certFile, keyFile: p.keyFile}
+        if err := np.load(); err != nil {
+            m.Logger.Printf("Error reloading certificate %s: %v\n", p.certFile, err)
+            if firstErr == nil {
+                firstErr = err
+            }
+            continue
+        }
+        m.Logger.Printf("Reloaded certificate %s\n", p.certFile)
+        updated = append(updated, p, np)
+    }
+    if len(updated) > 0 {
+        m.mu.Lock()
+        for i := 0; i < len(updated); i += 2 {
+            for j, p := range m.pairs {
+                if p == updated[i] {
+                    m.pairs[j] = updated[i+1]
+                }
+            }
+        }
+        m.index()
+        m.mu.Unlock()
+    }
+    m.checkExpiry()
+    return firstErr
+}
+
+// checkExpiry logs a warning, at most once a day, for every certificate
+// that expires within ExpiryWarning.
+func (m *CertManager) checkExpiry() {
+    now := time.Now()
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    for _, p := range m.pairs {
+        left := p.cert.Leaf.NotAfter.Sub(now)
+        if left > m.ExpiryWarning || now.Sub(p.warned) < 24*time.Hour {
+            continue
+        }
+        p.warned = now
+        if left <= 0 {
+            m.Logger.Printf("Certificate %s expired on %s\n", p.certFile, p.cert.Leaf.NotAfter.Format(time.RFC1123))
+        } else {
+            m.Logger.Printf("Certificate %s expires in %d days, on %s\n", p.certFile, int(left.Hours()/24), p.cert.Leaf.NotAfter.Format(time.RFC1123))
+        }
+    }
+}
+
+// Watch starts reloading changed certificates, both by checking the files
+// every interval (if interval is positive) and when the process receives
+// SIGHUP. On SIGHUP every certificate is reloaded. It returns immediately.
+func (m *CertManager) Watch(interval time.Duration) {
+    m.mu.Lock()
+    if m.stop != nil {
+        m.mu.Unlock()
+        return
+    }
+    m.stop = make(chan bool)
+    stop := m.stop
+    m.mu.Unlock()
+
+    hup := make(chan os.Signal, 1)
+    signal.Notify(hup, syscall.SIGHUP)
+    go func() {
+        defer signal.Stop(hup)
+        var tick <-chan time.Time
+        if interval > 0 {
+            ticker := time.NewTicker(interval)
+            defer ticker.Stop()
+            tick = ticker.C
+        }
+        for {
+            select {
+            case <-tick:
+                m.reload(false)
+            case <-hup:
+                m.reload(true)
+            case <-stop:
+                return
+            }
+        }
+    }()
+}
+
+// Stop stops watching for certificate changes.
+func (m *CertManager) Stop() {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if m.stop != nil {
+        close(m.stop)
+        m.stop = nil
+    }
+}
+
+// GetCertificate returns the certificate for the server name requested by
+// the client. It is meant for tls.Config.GetCertificate.
+func (m *CertManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+    m.mu.RLock()
+    defer m.mu.RUnlock()
+    if len(m.pairs) == 0 {
+        return nil, errors.New("no certificates loaded")
+    }
+    name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+    if cert, ok := m.names[name]; ok {
+        return cert, nil
+    }
+    //try a wildcard certificate for the parent domain
+    if i := strings.IndexByte(name, '.'); i > 0 {
+        if cert, ok := m.names["*"+name[i:]]; ok {
+            return cert, nil
+        }
+    }
+    return m.pairs[0].cert, nil
+}
+
+// TLSConfig returns a TLS configuration that takes its certificates from m.
+func (m *CertManager) TLSConfig() *tls.Config {
+    return &tls.Config{GetCertificate: m.GetCertificate}
+}
@@ -0,0 +1,172 @@
+package web
+
+import (
+    "bytes"
+    "compress/gzip"
+    "io"
+    "io/fs"
+    "mime"
+    "net/http"
+    "path"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const (
+    defaultCompressCacheSize = 16 << 20
+    //files smaller than this are not worth compressing
+    minCompressSize = 1024
+)
+
+// staticEncodings are the content codings of precompressed static files,
+// in order of preference, and the extensions of the files.
+var staticEncodings = []struct{ name, ext string }{
+    {"br", ".br"},
+    {"gzip", ".gz"},
+}
+
+// acceptedEncodings parses an Accept-Encoding header into the quality of
+// each content coding.
+func acceptedEncodings(header string) map[string]float64 {
+    accepted := map[string]float64{}
+    var wildcard float64 = -1
+    for _, item := range strings.Split(header, ",") {
+        coding, params, _ := strings.Cut(strings.TrimSpace(item), ";")
+        coding = strings.ToLower(strings.TrimSpace(coding))
+        if coding == "" {
+            continue
+        }
+        q := 1.0
+        if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+            if f, err := strconv.ParseFloat(v, 64); err == nil {
+                q = f
+            }
+        }
+        if coding == "*" {
+            wildcard = q
+        } else {
+            accepted[coding] = q
+        }
+    }
+    if wildcard >= 0 {
+        for _, enc := range staticEncodings {
+            if _, ok := accepted[enc.name]; !ok {
+                accepted[enc.name] = wildcard
+            }
+        }
+    }
+    return accepted
+}
+
+// isCompressible reports whether files of the content type compress well.
+func isCompressible(ctype string) bool {
+    ctype, _, _ = strings.Cut(ctype, ";")
+    switch ctype {
+    case "application/javascript", "text/javascript", "application/json", "application/xml", "image/svg+xml", "application/wasm":
+        return true
+    }
+    return strings.HasPrefix(ctype, "text/")
+}
+
+// serveFile serves the file name of fsys. If the client accepts it, a
+// precompressed version of the file, or one compressed on the fly, is
+// served instead.
+func (s *Server) serveFile(w http.ResponseWriter, req *http.Request, fsys fs.FS, name string) {
+    //let http.ServeFileFS redirect requests for index.html
+    if strings.HasSuffix(req.URL.Path, "/index.html") {
+        http.ServeFileFS(w, req, fsys, name)
+        return
+    }
+
+    ctype := mime.TypeByExtension(path.Ext(name))
+    accepted := acceptedEncodings(req.Header.Get("Accept-Encoding"))
+    compressible := s.Config.CompressStatic && isCompressible(ctype)
+
+    vary := compressible
+    var encoding, ext string
+    var bestQ float64
+    for _, enc := range staticEncodings {
+        if !fileExists(fsys, name+enc.ext) {
+            continue
+        }
+        vary = true
+        if q := accepted[enc.name]; q > bestQ {
+            encoding, ext, bestQ = enc.name, enc.ext, q
+        }
+    }
+    if vary {
+        w.Header().Add("Vary", "Accept-Encoding")
+    }
+    if encoding != "" && serveEncoded(w, req, fsys, name+ext, ctype, encoding) {
+        return
+    }
+    if compressible && accepted["gzip"] > 0 {
+        load := func() ([]byte, error) { return fs.ReadFile(fsys, name) }
+        //the URL path identifies the file among all static filesystems
+        fi, err := fs.Stat(fsys, name)
+        if err == nil && s.serveGzipped(w, req, req.URL.Path, name, ctype, fi.ModTime(), fi.Size(), load) {
+            return
+        }
+    }
+    http.ServeFileFS(w, req, fsys, name)
+}
+
+// serveEncoded serves the precompressed file name with the content type of
+// the original file.
+func serveEncoded(w http.ResponseWriter, req *http.Request, fsys fs.FS, name string, ctype string, encoding string) bool {
+    f, err := fsys.Open(name)
+    if err != nil {
+        return false
+    }
+    defer f.Close()
+    fi, err := f.Stat()
+    if err != nil {
+        return false
+    }
+    content, ok := f.(io.ReadSeeker)
+    if !ok {
+        data, err := io.ReadAll(f)
+        if err != nil {
+            return false
+        }
+        content = bytes.NewReader(data)
+    }
+    if ctype == "" {
+        ctype = "application/octet-stream"
+    }
+    w.Header().Set("Content-Type", ctype)
+    w.Header().Set("Content-Encoding", encoding)
+    http.ServeContent(w, req, name, fi.ModTime(), content)
+    return true
+}
+
+// serveGzipped compresses the file name and serves it, caching the
+// compressed data under key. load reads the file.
+func (s *Server) serveGzipped(w http.ResponseWriter, req *http.Request, key string, name string, ctype string, modTime time.Time, size int64, load func() ([]byte, error)) bool {
+    maxCache := s.Config.CompressCacheSize
+    if maxCache <= 0 {
+        maxCache = defaultCompressCacheSize
+    }
+    if size < minCompressSize || size > maxCache {
+        return false
+    }
+
+    data, ok := s.gzipCache.get(key, modTime, size)
+    if !ok {
+        raw, err := load()
+        if err != nil {
+            return false
+        }
+        var buf bytes.Buffer
+        zw := gzip.NewWriter(&buf)
+        zw.Write(raw)
+        zw.Close()
+        data = buf.Bytes()
+        s.gzipCache.put(&byteCacheEntry{key: key, data: data, modTime: modTime, fileSize: size}, maxCache)
+    }
+    w.Header().Set("Content-Type", ctype)
+    w.Header().Set("Content-Encoding", "gzip")
+    http.ServeContent(w, req, name, modTime, bytes.NewReader(data))
+    return true
+}
@@ -0,0 +1,168 @@
+package web
+
+import (
+    "net/http"
+    "strconv"
+    "strings"
+)
+
+// CORSConfig is the configuration for the CORS middleware.
+type CORSConfig struct {
+    // AllowedOrigins lists the origins that may make cross-origin requests.
+    // An entry may be an exact origin such as "https://example.com", a
+    // wildcard subdomain such as "https://*.example.com", or "*" for any origin.
+    AllowedOrigins []string
+    // AllowOriginFunc, if set, is consulted for origins that are not
+    // matched by AllowedOrigins.
+    AllowOriginFunc func(origin string) bool
+    // AllowedMethods lists the methods allowed in preflight requests. If
+    // empty, the methods of the routes that match the request path are allowed.
+    AllowedMethods []string
+    // AllowedHeaders lists the request headers allowed in preflight requests.
+    // "*" allows any header. Defaults to Accept, Content-Type and X-Requested-With.
+    AllowedHeaders []string
+    // ExposedHeaders lists response headers that browsers may expose to scripts.
+    ExposedHeaders []string
+    // AllowCredentials allows requests to include cookies and HTTP authentication.
+    AllowCredentials bool
+    // MaxAge is how long, in seconds, preflight results may be cached.
+    MaxAge int
+}
+
+// CORS returns a middleware that implements cross-origin resource sharing.
+// Preflight requests are answered for every path that matches a route, so
+// OPTIONS routes do not need to be registered by hand.
+func CORS(config *CORSConfig) Middleware {
+    c := CORSConfig{}
+    if config != nil {
+        c = *config
+    }
+    if len(c.AllowedHeaders) == 0 {
+        c.AllowedHeaders = []string{"Accept", "Content-Type", "X-Requested-With"}
+    }
+    anyOrigin := false
+    for _, o := range c.AllowedOrigins {
+        if o == "*" {
+            anyOrigin = true
+        }
+    }
+    anyHeader := false
+    allowedHeaders := map[string]bool{}
+    for _, h := range c.AllowedHeaders {
+        if h == "*" {
+            anyHeader = true
+        }
+        allowedHeaders[http.CanonicalHeaderKey(h)] = true
+    }
+
+    return func(ctx *Context, next func()) {
+        req := ctx.Request
+        origin := req.Header.Get("Origin")
+        // the response depends on the origin unless every origin gets the same answer
+        if !anyOrigin || c.AllowCredentials || c.AllowOriginFunc != nil {
+            ctx.SetHeader("Vary", "Origin", false)
+        }
+        if origin == "" {
+            next()
+            return
+        }
+
+        preflight := req.Method == "OPTIONS" && req.Header.Get("Access-Control-Request-Method") != ""
+        if !preflight {
+            if c.allowOrigin(origin, anyOrigin) {
+                c.setOrigin(ctx, origin, anyOrigin)
+                if len(c.ExposedHeaders) > 0 {
+                    ctx.SetHeader("Access-Control-Expose-Headers", strings.Join(c.ExposedHeaders, ", "), true)
+                }
+            }
+            next()
+            return
+        }
+
+        routeMethods := ctx.Server.routeMethods(req.URL.Path)
+        if len(routeMethods) == 0 {
+            next()
+            return
+        }
+        ctx.SetHeader("Vary", "Access-Control-Request-Method", false)
+        ctx.SetHeader("Vary", "Access-Control-Request-Headers", false)
+
+        methods := c.AllowedMethods
+        if len(methods) == 0 {
+            methods = routeMethods
+            for _, m := range routeMethods {
+                if m == "GET" {
+                    methods = append(methods, "HEAD")
+                }
+            }
+        }
+        method := req.Header.Get("Access-Control-Request-Method")
+        allowed := c.allowOrigin(origin, anyOrigin) && containsToken(methods, method)
+
+        var requested []string
+        for _, h := range strings.Split(req.Header.Get("Access-Control-Request-Headers"), ",") {
+            h = http.CanonicalHeaderKey(strings.TrimSpace(h))
+            if h == "" {
+                continue
+            }
+            if !anyHeader && !allowedHeaders[h] {
+                allowed = false
+            }
+            requested = append(requested, h)
+        }
+
+        if allowed {
+            c.setOrigin(ctx, origin, anyOrigin)
+            ctx.SetHeader("Access-Control-Allow-Methods", strings.Join(methods, ", "), true)
+            if len(requested) > 0 {
+                ctx.SetHeader("Access-Control-Allow-Headers", strings.Join(requested, ", "), true)
+            }
+            if c.MaxAge > 0 {
+                ctx.SetHeader("Access-Control-Max-Age", strconv.Itoa(c.MaxAge), true)
+            }
+        }
+        ctx.SetHeader("Content-Length", "0", true)
+        ctx.WriteHeader(204)
+    }
+}
+
+func (c *CORSConfig) allowOrigin(origin string, anyOrigin bool) bool {
+    if anyOrigin {
+        return true
+    }
+    for _, o := range c.AllowedOrigins {
+        if o == origin {
+            return true
+        }
+        if i := strings.Index(o, "://*."); i >= 0 {
+            // https://*.example.com matches https://a.example.com
+            scheme, domain := o[:i+3], o[i+4:]
+            if strings.HasPrefix(origin, scheme) && strings.HasSuffix(origin, domain) &&
+                len(origin) > len(scheme)+len(domain) {
+                return true
+            }
+        }
+    }
+    return c.AllowOriginFunc != nil && c.AllowOriginFunc(origin)
+}
+
+func (c *CORSConfig) setOrigin(ctx *Context, origin string, anyOrigin bool) {
+    if anyOrigin && !c.AllowCredentials {
+        ctx.SetHeader("Access-Control-Allow-Origin", "*", true)
+    } else {
+        ctx.SetHeader("Access-Control-Allow-Origin", origin, true)
+    }
+    if c.AllowCredentials {
+        ctx.SetHeader("Access-Control-Allow-Credentials", "true", true)
+    }
+}
+
+// containsToken reports whether list contains s, ignoring case.
+func containsToken(list []string, s string) bool {
+    for _, v := range list {
+        if strings.EqualFold(v, s) {
+            return true
+        }
+    }
+    return false
+}
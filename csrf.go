@@ -0,0 +1,121 @@
+package web
+
+import (
+    "crypto/rand"
+    "crypto/subtle"
+    "encoding/base64"
+    "net/http"
+    "regexp"
+)
+
+// CSRFConfig is the configuration for the CSRF middleware.
+type CSRFConfig struct {
+    // FieldName is the form field that carries the token. Defaults to "_csrf".
+    FieldName string
+    // HeaderName is the request header that carries the token. Defaults to "X-CSRF-Token".
+    HeaderName string
+    // CookieName is the name of the secure cookie holding the token. Defaults to "_csrf".
+    CookieName string
+    // Exempt lists route regular expressions that are not checked.
+    Exempt []string
+    // ErrorHandler is called when a request fails verification.
+    // The default handler responds with 403 Forbidden.
+    ErrorHandler func(ctx *Context)
+}
+
+type csrfState struct {
+    config *CSRFConfig
+    token  string
+}
+
+// CSRF returns a middleware that protects POST, PUT, DELETE and PATCH
+// requests against cross-site request forgery. Each client is given a
+// random token in a cookie signed with Config.CookieSecret, and unsafe
+// requests must echo the token back in a form field or header. Forms
+// obtain the token with ctx.CSRFToken. A nil config uses the defaults.
+func CSRF(config *CSRFConfig) Middleware {
+    c := CSRFConfig{}
+    if config != nil {
+        c = *config
+    }
+    if c.FieldName == "" {
+        c.FieldName = "_csrf"
+    }
+    if c.HeaderName == "" {
+        c.HeaderName = "X-CSRF-Token"
+    }
+    if c.CookieName == "" {
+        c.CookieName = "_csrf"
+    }
+    if c.ErrorHandler == nil {
+        c.ErrorHandler = func(ctx *Context) { ctx.Abort(403, "Forbidden") }
+    }
+    var exempt []*regexp.Regexp
+    for _, r := range c.Exempt {
+        exempt = append(exempt, regexp.MustCompile("^(?:"+r+")$"))
+    }
+
+    return func(ctx *Context, next func()) {
+        state := &csrfState{config: &c}
+        if len(ctx.Server.Config.CookieSecret) > 0 {
+            state.token, _ = ctx.GetSecureCookie(c.CookieName)
+        }
+        ctx.csrf = state
+
+        switch ctx.Request.Method {
+        case "POST", "PUT", "DELETE", "PATCH":
+        default:
+            next()
+            return
+        }
+        for _, cr := range exempt {
+            if cr.MatchString(ctx.Request.URL.Path) {
+                next()
+                return
+            }
+        }
+
+        sent := ctx.Request.Header.Get(c.HeaderName)
+        if sent == "" {
+            sent = ctx.BodyParam(c.FieldName)
+        }
+        if state.token == "" || subtle.ConstantTimeCompare([]byte(sent), []byte(state.token)) != 1 {
+            ctx.Server.Logger.Printf("CSRF token check failed for %s %s\n", ctx.Request.Method, ctx.Request.URL.Path)
+            c.ErrorHandler(ctx)
+            return
+        }
+        next()
+    }
+}
+
+// CSRFToken returns the CSRF token for the current client, to be embedded
+// in forms or sent in a request header. A token is created and its cookie
+// is set on first use, so it must be called before the response is written.
+// It returns an empty string if the CSRF middleware is not in use.
+func (ctx *Context) CSRFToken() string {
+    state := ctx.csrf
+    if state == nil {
+        return ""
+    }
+    if state.token != "" {
+        return state.token
+    }
+    secret := ctx.Server.Config.CookieSecret
+    if len(secret) == 0 {
+        ctx.Server.Logger.Println("Secret Key for secure cookies has not been set. Please assign a cookie secret to web.Config.CookieSecret.")
+        return ""
+    }
+    b := make([]byte, 32)
+    if _, err := rand.Read(b); err != nil {
+        ctx.Server.Logger.Println("Error generating CSRF token: ", err)
+        return ""
+    }
+    state.token = base64.RawURLEncoding.EncodeToString(b)
+    ctx.SetCookie(&http.Cookie{
+        Name:     state.config.CookieName,
+        Value:    encodeSecureCookie(secret, state.token),
+        Path:     "/",
+        HttpOnly: true,
+    })
+    return state.token
+}
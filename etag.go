@@ -0,0 +1,178 @@
+package web
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "encoding/hex"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// ETag returns a middleware that buffers the responses to GET and HEAD
+// requests, computes an ETag from the body and answers conditional
+// requests with 304 Not Modified or 412 Precondition Failed. Responses
+// that already have an ETag keep it. With weak set, the ETag is sent as a
+// weak validator, for bodies that are equivalent but not byte for byte
+// identical, e.g. compressed ones.
+//
+// Since it buffers whole responses, it is meant for the routes that
+// generate pages, not for streaming or large downloads. Other methods are
+// passed through: handlers of unsafe methods call ctx.CheckModified with
+// the validators of the resource they are about to change.
+func ETag(weak bool) Middleware {
+    return func(ctx *Context, next func()) {
+        if ctx.Request.Method != "GET" && ctx.Request.Method != "HEAD" {
+            next()
+            return
+        }
+
+        w := ctx.ResponseWriter
+        buf := &bufferedResponse{ResponseWriter: w}
+        ctx.ResponseWriter = buf
+        next()
+        ctx.ResponseWriter = w
+
+        status := buf.status
+        if status == 0 {
+            status = 200
+        }
+        header := w.Header()
+        if status == 200 {
+            etag := header.Get("ETag")
+            if etag == "" {
+                sum := sha256.Sum256(buf.body.Bytes())
+                etag = `"` + hex.EncodeToString(sum[:8]) + `"`
+                if weak {
+                    etag = "W/" + etag
+                }
+                header.Set("ETag", etag)
+            }
+            lastMod, _ := http.ParseTime(header.Get("Last-Modified"))
+            if code := checkPreconditions(ctx.Request, etag, lastMod); code != 0 {
+                writePreconditionFailure(ctx, code)
+                return
+            }
+        }
+        w.WriteHeader(status)
+        w.Write(buf.body.Bytes())
+    }
+}
+
+// bufferedResponse holds back the status and body of a response.
+type bufferedResponse struct {
+    http.ResponseWriter
+    status int
+    body   bytes.Buffer
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+    if b.status == 0 {
+        b.status = status
+    }
+}
+
+func (b *bufferedResponse) Write(data []byte) (int, error) {
+    if b.status == 0 {
+        b.status = 200
+    }
+    return b.body.Write(data)
+}
+
+// CheckModified evaluates the conditional request headers against the
+// current validators of the requested resource, its ETag and modification
+// time, either of which may be empty. Empty validators mean that the
+// resource does not exist. For GET and HEAD requests, the validators are
+// sent as the ETag and Last-Modified headers.
+//
+// If the client's copy is current, CheckModified writes 304 Not Modified,
+// and if a precondition of the request fails, e.g. the resource changed
+// since a client read it, 412 Precondition Failed. It returns false in
+// both cases, and the handler should return without doing any more work.
+func (ctx *Context) CheckModified(etag string, lastMod time.Time) bool {
+    if etag != "" && !strings.HasPrefix(etag, `"`) && !strings.HasPrefix(etag, `W/"`) {
+        etag = strconv.Quote(etag)
+    }
+    if ctx.Request.Method == "GET" || ctx.Request.Method == "HEAD" {
+        if etag != "" {
+            ctx.SetHeader("ETag", etag, true)
+        }
+        if !lastMod.IsZero() {
+            ctx.SetHeader("Last-Modified", webTime(lastMod.UTC()), true)
+        }
+    }
+    if code := checkPreconditions(ctx.Request, etag, lastMod); code != 0 {
+        writePreconditionFailure(ctx, code)
+        return false
+    }
+    return true
+}
+
+func writePreconditionFailure(ctx *Context, code int) {
+    header := ctx.Header()
+    header.Del("Content-Length")
+    if code == 304 {
+        header.Del("Content-Type")
+        ctx.NotModified()
+        return
+    }
+    ctx.Abort(code, "Precondition Failed")
+}
+
+// checkPreconditions evaluates the conditional request headers in the
+// order of RFC 7232, section 6. It returns 304 or 412 if the request should
+// not be processed, and 0 otherwise.
+func checkPreconditions(req *http.Request, etag string, lastMod time.Time) int {
+    exists := etag != "" || !lastMod.IsZero()
+    //HTTP dates have a resolution of a second
+    lastMod = lastMod.Truncate(time.Second)
+    isGet := req.Method == "GET" || req.Method == "HEAD"
+
+    if im := req.Header.Get("If-Match"); im != "" {
+        if !matchETag(im, etag, exists, true) {
+            return 412
+        }
+    } else if t, err := http.ParseTime(req.Header.Get("If-Unmodified-Since")); err == nil && !lastMod.IsZero() {
+        if lastMod.After(t) {
+            return 412
+        }
+    }
+
+    if inm := req.Header.Get("If-None-Match"); inm != "" {
+        if matchETag(inm, etag, exists, false) {
+            if isGet {
+                return 304
+            }
+            return 412
+        }
+    } else if t, err := http.ParseTime(req.Header.Get("If-Modified-Since")); err == nil && isGet && !lastMod.IsZero() {
+        if !lastMod.After(t) {
+            return 304
+        }
+    }
+    return 0
+}
+
+// matchETag reports whether the list of entity tags of a conditional
+// header matches etag. "*" matches any existing resource. The strong
+// comparison never matches weak tags.
+func matchETag(list string, etag string, exists bool, strong bool) bool {
+    if strings.TrimSpace(list) == "*" {
+        return exists
+    }
+    if etag == "" || strong && strings.HasPrefix(etag, "W/") {
+        return false
+    }
+    opaque := strings.TrimPrefix(etag, "W/")
+    for _, tag := range strings.Split(list, ",") {
+        tag = strings.TrimSpace(tag)
+        if strong && strings.HasPrefix(tag, "W/") {
+            continue
+        }
+        if strings.TrimPrefix(tag, "W/") == opaque {
+            return true
+        }
+    }
+    return false
+}
@@ -7,18 +7,21 @@ import (
     "time"
 )
 
-var form = `<form action="say" method="POST"><input name="said"><input type="submit"></form>`
+var form = `<form action="say" method="POST"><input type="hidden" name="_csrf" value="%s"><input name="said"><input type="submit"></form>`
 
 var users = map[string]string{}
 
 func main() {
     rand.Seed(time.Now().UnixNano())
     web.Config.CookieSecret = "7C19QRmwf3mHZ9CPAaPQ0hsWeufKd"
+    web.Use(web.CSRF(nil))
     web.Get("/", func(ctx *web.Context) string {
         ctx.Redirect(302, "/said")
         return ""
     })
-    web.Get("/said", func() string { return form })
+    web.Get("/said", func(ctx *web.Context) string {
+        return fmt.Sprintf(form, ctx.CSRFToken())
+    })
     web.Post("/say", func(ctx *web.Context) string {
         uid := fmt.Sprintf("%d\n", rand.Int63())
         ctx.SetSecureCookie("user", uid, 3600)
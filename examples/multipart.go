@@ -2,18 +2,11 @@ package main
 
 import (
     "bytes"
-    "crypto/md5"
-    "fmt"
     "github.com/hoisie/web"
     "io"
+    "io/ioutil"
 )
 
-func Md5(r io.Reader) string {
-    hash := md5.New()
-    io.Copy(hash, r)
-    return fmt.Sprintf("%x", hash.Sum(nil))
-}
-
 var page = `
 <html>
 <head><title>Multipart Test</title></head>
@@ -38,25 +31,34 @@ var page = `
 func index() string { return page }
 
 func multipart(ctx *web.Context) string {
-    ctx.Request.ParseMultipartForm(10 * 1024 * 1024)
-    form := ctx.Request.MultipartForm
-    var output bytes.Buffer
-    output.WriteString("<p>input1: " + form.Value["input1"][0] + "</p>")
-    output.WriteString("<p>input2: " + form.Value["input2"][0] + "</p>")
-
-    fileHeader := form.File["file"][0]
-    filename := fileHeader.Filename
-    file, err := fileHeader.Open()
+    reader, err := ctx.MultipartReader()
     if err != nil {
         return err.Error()
     }
-
-    output.WriteString("<p>file: " + filename + " " + Md5(file) + "</p>")
+    var output bytes.Buffer
+    for {
+        part, err := reader.NextPart()
+        if err == io.EOF {
+            break
+        } else if err != nil {
+            return err.Error()
+        }
+        if part.FileName == "" {
+            value, _ := ioutil.ReadAll(part)
+            output.WriteString("<p>" + part.FormName + ": " + string(value) + "</p>")
+            continue
+        }
+        //stream the file without storing it, computing its checksum
+        if _, err := io.Copy(ioutil.Discard, part); err != nil {
+            return err.Error()
+        }
+        output.WriteString("<p>file: " + part.FileName + " " + part.MD5() + "</p>")
+    }
     return output.String()
 }
 
 func main() {
     web.Get("/", index)
-    web.Post("/multipart", multipart)
+    web.BodyLimit(10*1024*1024).Post("/multipart", multipart)
     web.Run("0.0.0.0:9999")
 }
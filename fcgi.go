@@ -2,6 +2,7 @@ package web
 
 import (
     "net"
+    "net/http"
     "net/http/fcgi"
 )
 
@@ -11,9 +12,9 @@ func (s *Server) listenAndServeFcgi(addr string) error {
 
     //if the path begins with a "/", assume it's a unix address
     if addr[0] == '/' {
-        l, err = net.Listen("unix", addr)
+        l, err = s.listen("unix", addr)
     } else {
-        l, err = net.Listen("tcp", addr)
+        l, err = s.listen("tcp", addr)
     }
 
     //save the listener so it can be closed
@@ -23,5 +24,7 @@ func (s *Server) listenAndServeFcgi(addr string) error {
         s.Logger.Println("FCGI listen error", err.Error())
         return err
     }
-    return fcgi.Serve(s.l, s)
+    return fcgi.Serve(s.l, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+        s.Process(w, fromGateway(req))
+    }))
 }
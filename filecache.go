@@ -0,0 +1,220 @@
+package web
+
+import (
+    "bytes"
+    "container/list"
+    "crypto/sha256"
+    "encoding/hex"
+    "io/fs"
+    "mime"
+    "net/http"
+    "path"
+    "sync"
+    "time"
+)
+
+// byteCache is an LRU cache of data derived from files, bounded by the
+// total size of the data. The zero value is an empty cache.
+type byteCache struct {
+    mu      sync.Mutex
+    size    int64
+    items   map[string]*list.Element
+    lru     list.List
+    hits    int64
+    misses  int64
+    polling bool
+}
+
+type byteCacheEntry struct {
+    key      string
+    data     []byte
+    modTime  time.Time
+    fileSize int64
+
+    //the file itself, for the static file cache
+    mount *StaticMount
+    fsys  fs.FS
+    name  string
+    etag  string
+}
+
+// get returns the data cached under key if its file still has the given
+// modification time and size.
+func (c *byteCache) get(key string, modTime time.Time, fileSize int64) ([]byte, bool) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    el, ok := c.items[key]
+    if !ok {
+        return nil, false
+    }
+    entry := el.Value.(*byteCacheEntry)
+    if !entry.modTime.Equal(modTime) || entry.fileSize != fileSize {
+        c.remove(el)
+        return nil, false
+    }
+    c.lru.MoveToFront(el)
+    return entry.data, true
+}
+
+// lookup returns the entry cached under key without checking its file,
+// and counts a hit if there is one.
+func (c *byteCache) lookup(key string) (*byteCacheEntry, bool) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    el, ok := c.items[key]
+    if !ok {
+        return nil, false
+    }
+    c.hits++
+    c.lru.MoveToFront(el)
+    return el.Value.(*byteCacheEntry), true
+}
+
+// put caches entry, evicting the least recently used entries to keep the
+// total size of the cache below max.
+func (c *byteCache) put(entry *byteCacheEntry, max int64) {
+    if int64(len(entry.data)) > max {
+        return
+    }
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.items == nil {
+        c.items = map[string]*list.Element{}
+    }
+    if el, ok := c.items[entry.key]; ok {
+        c.remove(el)
+    }
+    c.items[entry.key] = c.lru.PushFront(entry)
+    c.size += int64(len(entry.data))
+    for c.size > max {
+        c.remove(c.lru.Back())
+    }
+}
+
+func (c *byteCache) remove(el *list.Element) {
+    entry := c.lru.Remove(el).(*byteCacheEntry)
+    delete(c.items, entry.key)
+    c.size -= int64(len(entry.data))
+}
+
+// invalidate removes entry if it is still cached.
+func (c *byteCache) invalidate(entry *byteCacheEntry) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if el, ok := c.items[entry.key]; ok && el.Value == entry {
+        c.remove(el)
+    }
+}
+
+// StaticCacheStats are the counters of the static file cache.
+type StaticCacheStats struct {
+    Hits   int64
+    Misses int64
+    Files  int
+    Bytes  int64
+}
+
+// StaticCacheStats returns the counters of the static file cache enabled
+// by ServerConfig.StaticCacheSize.
+func (s *Server) StaticCacheStats() StaticCacheStats {
+    c := &s.fileCache
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return StaticCacheStats{Hits: c.hits, Misses: c.misses, Files: len(c.items), Bytes: c.size}
+}
+
+// cacheStaticFile reads the static file name of fsys, which belongs to the
+// mount m or to no mount if m is nil, into the static file cache under key. It returns nil if the cache is disabled or the file is
+// not cacheable: files with precompressed versions are left to serveFile.
+func (s *Server) cacheStaticFile(key string, m *StaticMount, fsys fs.FS, name string) *byteCacheEntry {
+    max := s.Config.StaticCacheSize
+    if max <= 0 {
+        return nil
+    }
+    for _, enc := range staticEncodings {
+        if fileExists(fsys, name+enc.ext) {
+            return nil
+        }
+    }
+    fi, err := fs.Stat(fsys, name)
+    if err != nil || fi.Size() > max {
+        return nil
+    }
+    data, err := fs.ReadFile(fsys, name)
+    if err != nil {
+        return nil
+    }
+    sum := sha256.Sum256(data)
+    entry := &byteCacheEntry{
+        key:      key,
+        data:     data,
+        modTime:  fi.ModTime(),
+        fileSize: fi.Size(),
+        mount:    m,
+        fsys:     fsys,
+        name:     name,
+        etag:     `"` + hex.EncodeToString(sum[:8]) + `"`,
+    }
+
+    c := &s.fileCache
+    c.put(entry, max)
+    c.mu.Lock()
+    c.misses++
+    startPolling := !c.polling
+    c.polling = true
+    c.mu.Unlock()
+    if startPolling {
+        go s.pollStaticCache()
+    }
+    return entry
+}
+
+// pollStaticCache removes the files that changed from the static file
+// cache, every Config.StaticCachePoll. It stops when the cache is empty.
+func (s *Server) pollStaticCache() {
+    c := &s.fileCache
+    for {
+        interval := s.Config.StaticCachePoll
+        if interval <= 0 {
+            interval = 2 * time.Second
+        }
+        time.Sleep(interval)
+
+        c.mu.Lock()
+        if len(c.items) == 0 {
+            c.polling = false
+            c.mu.Unlock()
+            return
+        }
+        var entries []*byteCacheEntry
+        for el := c.lru.Front(); el != nil; el = el.Next() {
+            entries = append(entries, el.Value.(*byteCacheEntry))
+        }
+        c.mu.Unlock()
+
+        for _, entry := range entries {
+            fi, err := fs.Stat(entry.fsys, entry.name)
+            if err != nil || !fi.ModTime().Equal(entry.modTime) || fi.Size() != entry.fileSize {
+                c.invalidate(entry)
+            }
+        }
+    }
+}
+
+// serveCachedFile serves a file from the static file cache.
+func (s *Server) serveCachedFile(w http.ResponseWriter, req *http.Request, entry *byteCacheEntry) {
+    ctype := mime.TypeByExtension(path.Ext(entry.name))
+    if ctype == "" {
+        ctype = http.DetectContentType(entry.data)
+    }
+    if s.Config.CompressStatic && isCompressible(ctype) {
+        w.Header().Add("Vary", "Accept-Encoding")
+        load := func() ([]byte, error) { return entry.data, nil }
+        if acceptedEncodings(req.Header.Get("Accept-Encoding"))["gzip"] > 0 && s.serveGzipped(w, req, entry.key, entry.name, ctype, entry.modTime, entry.fileSize, load) {
+            return
+        }
+    }
+    w.Header().Set("Content-Type", ctype)
+    w.Header().Set("ETag", entry.etag)
+    http.ServeContent(w, req, entry.name, entry.modTime, bytes.NewReader(entry.data))
+}
@@ -2,6 +2,7 @@ package web
 
 import (
     "bytes"
+    "io/fs"
     "net/http"
     "net/url"
     "os"
@@ -31,8 +32,8 @@ func dirExists(dir string) bool {
     return true
 }
 
-func fileExists(dir string) bool {
-    info, err := os.Stat(dir)
+func fileExists(fsys fs.FS, name string) bool {
+    info, err := fs.Stat(fsys, name)
     if err != nil {
         return false
     }
@@ -0,0 +1,462 @@
+package web
+
+import (
+    "crypto"
+    "crypto/ecdsa"
+    "crypto/ed25519"
+    "crypto/elliptic"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "math/big"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Claims holds the claims of a JSON Web Token.
+type Claims map[string]interface{}
+
+// String returns the string claim named name, or an empty string.
+func (c Claims) String(name string) string {
+    s, _ := c[name].(string)
+    return s
+}
+
+// Time returns the numeric date claim named name, such as "exp" or "iat".
+func (c Claims) Time(name string) (time.Time, bool) {
+    switch v := c[name].(type) {
+    case float64:
+        return time.Unix(int64(v), 0), true
+    case json.Number:
+        n, err := v.Int64()
+        return time.Unix(n, 0), err == nil
+    }
+    return time.Time{}, false
+}
+
+// Audience returns the "aud" claim, which may be a string or a list.
+func (c Claims) Audience() []string {
+    switch v := c["aud"].(type) {
+    case string:
+        return []string{v}
+    case []interface{}:
+        var aud []string
+        for _, a := range v {
+            if s, ok := a.(string); ok {
+                aud = append(aud, s)
+            }
+        }
+        return aud
+    }
+    return nil
+}
+
+// Claims returns the claims of the JWT that authenticated the request,
+// or nil if the JWT middleware did not run.
+func (ctx *Context) Claims() Claims {
+    return ctx.claims
+}
+
+var (
+    errTokenMalformed = errors.New("malformed token")
+    errTokenAlgorithm = errors.New("unexpected signing algorithm")
+    errTokenKey       = errors.New("no verification key for token")
+    errTokenSignature = errors.New("invalid token signature")
+    errTokenExpired   = errors.New("token has expired")
+    errTokenNotYet    = errors.New("token is not valid yet")
+    errTokenIssuer    = errors.New("unexpected token issuer")
+    errTokenAudience  = errors.New("unexpected token audience")
+    errTokenMissing   = errors.New("missing bearer token")
+)
+
+// JWTConfig is the configuration for the JWT middleware.
+type JWTConfig struct {
+    // Key is the verification key used when KeySet is nil: a []byte
+    // secret for HS256, or an *rsa.PublicKey, *ecdsa.PublicKey or
+    // ed25519.PublicKey.
+    Key interface{}
+    // KeySet, if set, provides the verification keys, selected by the
+    // "kid" header of the token.
+    KeySet *JWKS
+    // Algorithms lists the accepted algorithms. Defaults to HS256, RS256,
+    // ES256 and EdDSA; each is only accepted with a key of the matching type.
+    Algorithms []string
+    // Issuer and Audience, if set, must match the "iss" and "aud" claims.
+    Issuer   string
+    Audience string
+    // Leeway is the clock skew allowed when checking "exp" and "nbf".
+    Leeway time.Duration
+    // CookieName, if set, is a cookie that is checked for the token when
+    // the request has no Authorization header.
+    CookieName string
+    // ErrorHandler is called when a request has a missing or invalid token.
+    // The default handler responds with 401 and a Bearer challenge.
+    ErrorHandler func(ctx *Context, err error)
+}
+
+// JWT returns a middleware that authenticates requests with a JSON Web Token
+// sent as a bearer token. The claims of a valid token are available through
+// ctx.Claims, and its subject through ctx.User. The config is required,
+// since it holds the verification keys.
+func JWT(config *JWTConfig) Middleware {
+    if config == nil {
+        panic("web: JWT requires a config")
+    }
+    c := *config
+    if len(c.Algorithms) == 0 {
+        c.Algorithms = []string{"HS256", "RS256", "ES256", "EdDSA"}
+    }
+    if c.ErrorHandler == nil {
+        c.ErrorHandler = func(ctx *Context, err error) {
+            challenge := `Bearer error="invalid_token", error_description=` + strconv.Quote(err.Error())
+            if err == errTokenMissing {
+                challenge = "Bearer"
+            }
+            ctx.SetHeader("WWW-Authenticate", challenge, true)
+            ctx.Abort(401, "Unauthorized")
+        }
+    }
+    return func(ctx *Context, next func()) {
+        var token string
+        if auth := ctx.Request.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+            token = strings.TrimSpace(auth[7:])
+        } else if c.CookieName != "" {
+            if cookie, err := ctx.Request.Cookie(c.CookieName); err == nil {
+                token = cookie.Value
+            }
+        }
+        if token == "" {
+            c.ErrorHandler(ctx, errTokenMissing)
+            return
+        }
+        claims, err := c.parse(token, time.Now())
+        if err != nil {
+            ctx.Server.Logger.Println("JWT rejected: ", err)
+            c.ErrorHandler(ctx, err)
+            return
+        }
+        ctx.claims = claims
+        ctx.user = claims.String("sub")
+        next()
+    }
+}
+
+// parse verifies the signature and the registered claims of token.
+func (c *JWTConfig) parse(token string, now time.Time) (Claims, error) {
+    parts := strings.Split(token, ".")
+    if len(parts) != 3 {
+        return nil, errTokenMalformed
+    }
+    var header struct {
+        Alg string `json:"alg"`
+        Kid string `json:"kid"`
+    }
+    if err := decodeJWTPart(parts[0], &header); err != nil {
+        return nil, err
+    }
+    if !containsToken(c.Algorithms, header.Alg) {
+        return nil, errTokenAlgorithm
+    }
+    key := c.Key
+    if c.KeySet != nil {
+        var ok bool
+        if key, ok = c.KeySet.Key(header.Kid); !ok {
+            return nil, errTokenKey
+        }
+    }
+    if key == nil {
+        return nil, errTokenKey
+    }
+    sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+    if err != nil {
+        return nil, errTokenMalformed
+    }
+    if err := verifyJWTSignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+        return nil, err
+    }
+
+    var claims Claims
+    if err := decodeJWTPart(parts[1], &claims); err != nil {
+        return nil, err
+    }
+    if exp, ok := claims.Time("exp"); ok && !now.Before(exp.Add(c.Leeway)) {
+        return nil, errTokenExpired
+    }
+    if nbf, ok := claims.Time("nbf"); ok && now.Add(c.Leeway).Before(nbf) {
+        return nil, errTokenNotYet
+    }
+    if c.Issuer != "" && claims.String("iss") != c.Issuer {
+        return nil, errTokenIssuer
+    }
+    if c.Audience != "" && !containsToken(claims.Audience(), c.Audience) {
+        return nil, errTokenAudience
+    }
+    return claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+    data, err := base64.RawURLEncoding.DecodeString(part)
+    if err != nil {
+        return errTokenMalformed
+    }
+    if err := json.Unmarshal(data, v); err != nil {
+        return errTokenMalformed
+    }
+    return nil
+}
+
+func verifyJWTSignature(alg string, key interface{}, signed []byte, sig []byte) error {
+    digest := sha256.Sum256(signed)
+    valid := false
+    switch alg {
+    case "HS256":
+        k, ok := key.([]byte)
+        if !ok {
+            return errTokenAlgorithm
+        }
+        mac := hmac.New(sha256.New, k)
+        mac.Write(signed)
+        valid = hmac.Equal(mac.Sum(nil), sig)
+    case "RS256":
+        k, ok := key.(*rsa.PublicKey)
+        if !ok {
+            return errTokenAlgorithm
+        }
+        valid = rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) == nil
+    case "ES256":
+        k, ok := key.(*ecdsa.PublicKey)
+        if !ok || k.Curve != elliptic.P256() {
+            return errTokenAlgorithm
+        }
+        if len(sig) == 64 {
+            r := new(big.Int).SetBytes(sig[:32])
+            s := new(big.Int).SetBytes(sig[32:])
+            valid = ecdsa.Verify(k, digest[:], r, s)
+        }
+    case "EdDSA":
+        k, ok := key.(ed25519.PublicKey)
+        if !ok {
+            return errTokenAlgorithm
+        }
+        valid = ed25519.Verify(k, signed, sig)
+    default:
+        return errTokenAlgorithm
+    }
+    if !valid {
+        return errTokenSignature
+    }
+    return nil
+}
+
+// SignJWT returns a JSON Web Token carrying claims, signed with key using
+// alg. The key is a []byte secret for HS256, or an *rsa.PrivateKey,
+// *ecdsa.PrivateKey or ed25519.PrivateKey for RS256, ES256 and EdDSA.
+// If kid is not empty it is added to the token header.
+func SignJWT(claims Claims, alg string, key interface{}, kid string) (string, error) {
+    header := map[string]string{"alg": alg, "typ": "JWT"}
+    if kid != "" {
+        header["kid"] = kid
+    }
+    h, err := json.Marshal(header)
+    if err != nil {
+        return "", err
+    }
+    p, err := json.Marshal(claims)
+    if err != nil {
+        return "", err
+    }
+    signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(p)
+    digest := sha256.Sum256([]byte(signed))
+
+    var sig []byte
+    switch k := key.(type) {
+    case []byte:
+        if alg != "HS256" {
+            return "", errTokenAlgorithm
+        }
+        mac := hmac.New(sha256.New, k)
+        mac.Write([]byte(signed))
+        sig = mac.Sum(nil)
+    case *rsa.PrivateKey:
+        if alg != "RS256" {
+            return "", errTokenAlgorithm
+        }
+        if sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+            return "", err
+        }
+    case *ecdsa.PrivateKey:
+        if alg != "ES256" || k.Curve != elliptic.P256() {
+            return "", errTokenAlgorithm
+        }
+        r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+        if err != nil {
+            return "", err
+        }
+        sig = make([]byte, 64)
+        r.FillBytes(sig[:32])
+        s.FillBytes(sig[32:])
+    case ed25519.PrivateKey:
+        if alg != "EdDSA" {
+            return "", errTokenAlgorithm
+        }
+        sig = ed25519.Sign(k, []byte(signed))
+    default:
+        return "", fmt.Errorf("unsupported signing key type %T", key)
+    }
+    return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// JWKS is a set of verification keys loaded from a JSON Web Key Set file.
+// The file is checked for changes at most once per reload interval, and
+// reloaded when its modification time changes.
+type JWKS struct {
+    path     string
+    interval time.Duration
+    logger   *log.Logger
+
+    mu      sync.Mutex
+    keys    map[string]interface{}
+    modTime time.Time
+    checked time.Time
+}
+
+// LoadJWKS loads the key set in the file at path. Encryption keys and keys
+// of unsupported types are skipped and reported to logger, which defaults
+// to a logger writing to standard output like the server's. If interval is
+// positive, the file is checked for changes when keys are looked up, at
+// most once per interval.
+func LoadJWKS(path string, interval time.Duration, logger *log.Logger) (*JWKS, error) {
+    if logger == nil {
+        logger = log.New(os.Stdout, "", log.Ldate|log.Ltime)
+    }
+    k := &JWKS{path: path, interval: interval, logger: logger}
+    if err := k.load(); err != nil {
+        return nil, err
+    }
+    return k, nil
+}
+
+// Key returns the key with the given key id. If kid is empty and the set
+// holds a single key, that key is returned.
+func (k *JWKS) Key(kid string) (interface{}, bool) {
+    k.mu.Lock()
+    defer k.mu.Unlock()
+    if k.interval > 0 && time.Since(k.checked) >= k.interval {
+        k.checked = time.Now()
+        if info, err := os.Stat(k.path); err == nil && !info.ModTime().Equal(k.modTime) {
+            //keep serving the old keys if the new file is broken
+            k.loadLocked()
+        }
+    }
+    if kid == "" && len(k.keys) == 1 {
+        for _, key := range k.keys {
+            return key, true
+        }
+    }
+    key, ok := k.keys[kid]
+    return key, ok
+}
+
+func (k *JWKS) load() error {
+    k.mu.Lock()
+    defer k.mu.Unlock()
+    k.checked = time.Now()
+    return k.loadLocked()
+}
+
+func (k *JWKS) loadLocked() error {
+    info, err := os.Stat(k.path)
+    if err != nil {
+        return err
+    }
+    data, err := ioutil.ReadFile(k.path)
+    if err != nil {
+        return err
+    }
+    var set struct {
+        Keys []jsonWebKey `json:"keys"`
+    }
+    if err := json.Unmarshal(data, &set); err != nil {
+        return err
+    }
+    //key sets often hold keys for other uses and algorithms, which are
+    //skipped rather than failing the whole set
+    keys := map[string]interface{}{}
+    for _, jwk := range set.Keys {
+        if jwk.Use == "enc" {
+            continue
+        }
+        key, err := jwk.publicKey()
+        if err != nil {
+            k.logger.Printf("JWKS %s: skipping key %q: %v\n", k.path, jwk.Kid, err)
+            continue
+        }
+        keys[jwk.Kid] = key
+    }
+    if len(keys) == 0 {
+        return errors.New("no usable keys in " + k.path)
+    }
+    k.keys = keys
+    k.modTime = info.ModTime()
+    return nil
+}
+
+type jsonWebKey struct {
+    Kty string `json:"kty"`
+    Kid string `json:"kid"`
+    Use string `json:"use"`
+    Crv string `json:"crv"`
+    N   string `json:"n"`
+    E   string `json:"e"`
+    X   string `json:"x"`
+    Y   string `json:"y"`
+    K   string `json:"k"`
+}
+
+func (jwk *jsonWebKey) publicKey() (interface{}, error) {
+    decode := func(s string) []byte {
+        b, _ := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+        return b
+    }
+    switch jwk.Kty {
+    case "oct":
+        k := decode(jwk.K)
+        if len(k) == 0 {
+            return nil, errors.New("empty oct key")
+        }
+        return k, nil
+    case "RSA":
+        n, e := decode(jwk.N), decode(jwk.E)
+        if len(n) == 0 || len(e) == 0 || len(e) > 4 {
+            return nil, errors.New("invalid RSA key")
+        }
+        return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+    case "EC":
+        x, y := decode(jwk.X), decode(jwk.Y)
+        if jwk.Crv != "P-256" || len(x) != 32 || len(y) != 32 {
+            return nil, errors.New("unsupported EC key")
+        }
+        key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+        if !key.Curve.IsOnCurve(key.X, key.Y) {
+            return nil, errors.New("invalid EC key")
+        }
+        return key, nil
+    case "OKP":
+        x := decode(jwk.X)
+        if jwk.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+            return nil, errors.New("unsupported OKP key")
+        }
+        return ed25519.PublicKey(x), nil
+    }
+    return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+}
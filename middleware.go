@@ -0,0 +1,81 @@
+package web
+
+// A Middleware wraps the processing of a request. It may inspect or modify
+// the context, write a response itself, and decides whether the rest of
+// the chain runs by calling next.
+type Middleware func(ctx *Context, next func())
+
+// runMiddleware runs the middleware chain in order, followed by final.
+func runMiddleware(ctx *Context, chain []Middleware, final func()) {
+    if len(chain) == 0 {
+        final()
+        return
+    }
+    chain[0](ctx, func() { runMiddleware(ctx, chain[1:], final) })
+}
+
+// Use adds middleware that runs for every request to server s, before
+// static files are served and routes are matched.
+func (s *Server) Use(middleware ...Middleware) {
+    s.middleware = append(s.middleware, middleware...)
+}
+
+// A RouteGroup registers routes that share a path prefix and a set of
+// middleware. Group middleware runs after the server's middleware, and
+// only for requests that match one of the group's routes.
+type RouteGroup struct {
+    s          *Server
+    prefix     string
+    middleware []Middleware
+    access     []*Access
+    maxBody    int64
+}
+
+// Group returns a route group for server s. The prefix is prepended to
+// the regular expression of every route added to the group.
+func (s *Server) Group(prefix string, middleware ...Middleware) *RouteGroup {
+    return &RouteGroup{s: s, prefix: prefix, middleware: middleware}
+}
+
+// Use adds middleware to the group. It only applies to routes added
+// after the call.
+func (g *RouteGroup) Use(middleware ...Middleware) {
+    g.middleware = append(g.middleware, middleware...)
+}
+
+// Group returns a nested group that inherits the prefix and middleware of g.
+func (g *RouteGroup) Group(prefix string, middleware ...Middleware) *RouteGroup {
+    var chain []Middleware
+    chain = append(chain, g.middleware...)
+    chain = append(chain, middleware...)
+    return &RouteGroup{s: g.s, prefix: g.prefix + prefix, middleware: chain, access: g.access, maxBody: g.maxBody}
+}
+
+func (g *RouteGroup) addRoute(r string, method string, handler interface{}) {
+    g.s.addGroupRoute(g, r, method, handler)
+}
+
+// Get adds a handler for the 'GET' http method to group g.
+func (g *RouteGroup) Get(route string, handler interface{}) {
+    g.addRoute(route, "GET", handler)
+}
+
+// Post adds a handler for the 'POST' http method to group g.
+func (g *RouteGroup) Post(route string, handler interface{}) {
+    g.addRoute(route, "POST", handler)
+}
+
+// Put adds a handler for the 'PUT' http method to group g.
+func (g *RouteGroup) Put(route string, handler interface{}) {
+    g.addRoute(route, "PUT", handler)
+}
+
+// Delete adds a handler for the 'DELETE' http method to group g.
+func (g *RouteGroup) Delete(route string, handler interface{}) {
+    g.addRoute(route, "DELETE", handler)
+}
+
+// Match adds a handler for an arbitrary http method to group g.
+func (g *RouteGroup) Match(method string, route string, handler interface{}) {
+    g.addRoute(route, method, handler)
+}
@@ -0,0 +1,177 @@
+package web
+
+import (
+    "crypto/tls"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/pem"
+    "errors"
+    "io/ioutil"
+    "net/url"
+    "strings"
+)
+
+// clientAuthConfig returns config with client certificate verification
+// enabled if Config.ClientCAFile is set.
+func (s *Server) clientAuthConfig(config *tls.Config) (*tls.Config, error) {
+    if s.Config.ClientCAFile == "" {
+        return config, nil
+    }
+    pool, err := s.clientCAPool()
+    if err != nil {
+        return nil, err
+    }
+    if config == nil {
+        config = &tls.Config{}
+    } else {
+        config = config.Clone()
+    }
+    config.ClientCAs = pool
+    if s.Config.ClientCertRequired {
+        config.ClientAuth = tls.RequireAndVerifyClientCert
+    } else {
+        config.ClientAuth = tls.VerifyClientCertIfGiven
+    }
+    return config, nil
+}
+
+// clientCAPool loads Config.ClientCAFile once.
+func (s *Server) clientCAPool() (*x509.CertPool, error) {
+    s.clientCAsOnce.Do(func() {
+        data, err := ioutil.ReadFile(s.Config.ClientCAFile)
+        if err != nil {
+            s.clientCAsErr = err
+            return
+        }
+        pool := x509.NewCertPool()
+        if !pool.AppendCertsFromPEM(data) {
+            s.clientCAsErr = errors.New("no certificates found in " + s.Config.ClientCAFile)
+            return
+        }
+        s.clientCAs = pool
+    })
+    return s.clientCAs, s.clientCAsErr
+}
+
+// ClientCert returns the verified certificate the client authenticated
+// with, or nil. The certificate comes from the TLS connection or, if
+// Config.ClientCertHeader is set, from a header forwarded by a trusted
+// proxy. Forwarded certificates must also verify against
+// Config.ClientCAFile and are ignored if it is not set. That check does not
+// stop a client from sending the header itself: certificates are public,
+// so trust rests entirely on the proxy always overwriting the header.
+func (ctx *Context) ClientCert() *x509.Certificate {
+    if ctx.clientCertDone {
+        return ctx.clientCert
+    }
+    ctx.clientCertDone = true
+
+    req := ctx.Request
+    if req.TLS != nil {
+        //unverified certificates are ignored
+        if len(req.TLS.VerifiedChains) > 0 {
+            ctx.clientCert = req.TLS.VerifiedChains[0][0]
+        }
+        return ctx.clientCert
+    }
+
+    s := ctx.Server
+    header := s.Config.ClientCertHeader
+    if header == "" || req.Header.Get(header) == "" || !s.fromTrustedProxy(req) {
+        return nil
+    }
+    if s.Config.ClientCAFile == "" {
+        s.Logger.Println("Forwarded client certificate ignored: ClientCAFile is not set")
+        return nil
+    }
+    cert, err := parseForwardedCert(req.Header.Get(header))
+    if err != nil {
+        s.Logger.Println("Invalid forwarded client certificate: ", err)
+        return nil
+    }
+    pool, err := s.clientCAPool()
+    if err != nil {
+        s.Logger.Println("Error loading client CAs: ", err)
+        return nil
+    }
+    opts := x509.VerifyOptions{Roots: pool, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}
+    if _, err := cert.Verify(opts); err != nil {
+        s.Logger.Println("Forwarded client certificate not trusted: ", err)
+        return nil
+    }
+    ctx.clientCert = cert
+    return cert
+}
+
+// parseForwardedCert parses a certificate forwarded by a proxy, either as
+// URL-escaped PEM (nginx $ssl_client_escaped_cert) or base64 DER.
+func parseForwardedCert(value string) (*x509.Certificate, error) {
+    if unescaped, err := url.PathUnescape(value); err == nil {
+        value = unescaped
+    }
+    if strings.Contains(value, "-----BEGIN") {
+        block, _ := pem.Decode([]byte(value))
+        if block == nil {
+            return nil, errors.New("invalid PEM data")
+        }
+        return x509.ParseCertificate(block.Bytes)
+    }
+    der, err := base64.StdEncoding.DecodeString(value)
+    if err != nil {
+        return nil, err
+    }
+    return x509.ParseCertificate(der)
+}
+
+// certIdentities returns the subject common name and the DNS, email and
+// URI subject alternative names of cert.
+func certIdentities(cert *x509.Certificate) []string {
+    var ids []string
+    if cert.Subject.CommonName != "" {
+        ids = append(ids, cert.Subject.CommonName)
+    }
+    ids = append(ids, cert.DNSNames...)
+    ids = append(ids, cert.EmailAddresses...)
+    for _, u := range cert.URIs {
+        ids = append(ids, u.String())
+    }
+    return ids
+}
+
+// RequireClientCert returns a middleware that only admits requests with a
+// verified client certificate. If identities are given, the certificate's
+// common name or one of its DNS, email or URI subject alternative names
+// must be among them. The matching identity becomes ctx.User, unless
+// another middleware already authenticated the request.
+func RequireClientCert(identities ...string) Middleware {
+    return func(ctx *Context, next func()) {
+        cert := ctx.ClientCert()
+        if cert == nil {
+            ctx.Abort(403, "Forbidden")
+            return
+        }
+        ids := certIdentities(cert)
+        identity := ""
+        if len(ids) > 0 {
+            identity = ids[0]
+        }
+        if len(identities) > 0 {
+            identity = ""
+            for _, id := range ids {
+                if containsString(identities, id) {
+                    identity = id
+                    break
+                }
+            }
+            if identity == "" {
+                ctx.Server.Logger.Printf("Client certificate %q not allowed for %s\n", cert.Subject.CommonName, ctx.Request.URL.Path)
+                ctx.Abort(403, "Forbidden")
+                return
+            }
+        }
+        if ctx.user == "" {
+            ctx.user = identity
+        }
+        next()
+    }
+}
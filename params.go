@@ -0,0 +1,150 @@
+package web
+
+import (
+    "errors"
+    "mime"
+    "net/http"
+    "net/url"
+    "strconv"
+)
+
+// isMultipart reports whether the body of req is a multipart form.
+func isMultipart(req *http.Request) bool {
+    ct, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+    return ct == "multipart/form-data"
+}
+
+// ParseForm parses the request body of url-encoded and multipart forms and
+// adds the first value of every parameter to ctx.Params, which initially
+// holds only the query parameters. The form is parsed once; later calls
+// return the same error. The param accessors call ParseForm implicitly,
+// and it is called before a handler that takes a *Context is invoked,
+// except for multipart forms, which are only parsed on first access.
+func (ctx *Context) ParseForm() error {
+    if ctx.formParsed {
+        return ctx.formErr
+    }
+    ctx.formParsed = true
+
+    req := ctx.Request
+    err := req.ParseForm()
+    if err == nil && isMultipart(req) {
+        err = ctx.Server.parseMultipart(ctx)
+    }
+    var maxBytesErr *http.MaxBytesError
+    if errors.As(err, &maxBytesErr) {
+        err = ErrFormTooLarge
+    }
+
+    maxFields := ctx.Server.Config.MaxFormFields
+    if maxFields <= 0 {
+        maxFields = defaultMaxFormFields
+    }
+    n := 0
+    for k, v := range req.Form {
+        n += len(v)
+        if len(v) > 0 {
+            ctx.Params[k] = v[0]
+        }
+    }
+    if err == nil && n > maxFields {
+        err = ErrFormTooLarge
+    }
+    ctx.formErr = err
+    return err
+}
+
+// queryValues returns the parsed query string of the request.
+func (ctx *Context) queryValues() url.Values {
+    if ctx.query == nil {
+        ctx.query, _ = url.ParseQuery(ctx.Request.URL.RawQuery)
+    }
+    return ctx.query
+}
+
+// Param returns the first value of the named parameter from the request
+// body or the query string. Body values take precedence.
+func (ctx *Context) Param(name string) string {
+    if v := ctx.ParamValues(name); len(v) > 0 {
+        return v[0]
+    }
+    return ""
+}
+
+// ParamValues returns all values of the named parameter, body values
+// before query values.
+func (ctx *Context) ParamValues(name string) []string {
+    ctx.ParseForm()
+    return ctx.Request.Form[name]
+}
+
+// ParamInt returns the named parameter as an int, or def if it is missing
+// or malformed.
+func (ctx *Context) ParamInt(name string, def int) int {
+    if i, err := strconv.Atoi(ctx.Param(name)); err == nil {
+        return i
+    }
+    return def
+}
+
+// ParamInt64 returns the named parameter as an int64, or def if it is
+// missing or malformed.
+func (ctx *Context) ParamInt64(name string, def int64) int64 {
+    if i, err := strconv.ParseInt(ctx.Param(name), 10, 64); err == nil {
+        return i
+    }
+    return def
+}
+
+// ParamFloat returns the named parameter as a float64, or def if it is
+// missing or malformed.
+func (ctx *Context) ParamFloat(name string, def float64) float64 {
+    if f, err := strconv.ParseFloat(ctx.Param(name), 64); err == nil {
+        return f
+    }
+    return def
+}
+
+// ParamBool returns the named parameter as a bool, or def if it is
+// missing or malformed. An empty value, as in "?verbose", is true.
+func (ctx *Context) ParamBool(name string, def bool) bool {
+    values := ctx.ParamValues(name)
+    if len(values) == 0 {
+        return def
+    }
+    if values[0] == "" {
+        return true
+    }
+    if b, err := strconv.ParseBool(values[0]); err == nil {
+        return b
+    }
+    return def
+}
+
+// QueryParam returns the first value of the named parameter in the query
+// string. It does not read the request body.
+func (ctx *Context) QueryParam(name string) string {
+    return ctx.queryValues().Get(name)
+}
+
+// QueryValues returns all values of the named parameter in the query
+// string.
+func (ctx *Context) QueryValues(name string) []string {
+    return ctx.queryValues()[name]
+}
+
+// BodyParam returns the first value of the named parameter in a
+// url-encoded or multipart request body.
+func (ctx *Context) BodyParam(name string) string {
+    if v := ctx.BodyValues(name); len(v) > 0 {
+        return v[0]
+    }
+    return ""
+}
+
+// BodyValues returns all values of the named parameter in a url-encoded or
+// multipart request body.
+func (ctx *Context) BodyValues(name string) []string {
+    ctx.ParseForm()
+    return ctx.Request.PostForm[name]
+}
@@ -0,0 +1,208 @@
+package web
+
+import (
+    "context"
+    "log"
+    "net"
+    "net/http"
+    "strings"
+)
+
+type gatewayKey struct{}
+
+// fromGateway marks a request received over SCGI or FastCGI, where the
+// peer is the web server acting as a reverse proxy.
+func fromGateway(req *http.Request) *http.Request {
+    return req.WithContext(context.WithValue(req.Context(), gatewayKey{}, true))
+}
+
+// parseProxyList parses a list of IP addresses and CIDR ranges. Invalid
+// entries are logged to logger and skipped.
+func parseProxyList(list []string, logger *log.Logger) []*net.IPNet {
+    var nets []*net.IPNet
+    for _, p := range list {
+        if !strings.Contains(p, "/") {
+            if ip := net.ParseIP(p); ip != nil {
+                bits := 8 * len(ip)
+                if ip4 := ip.To4(); ip4 != nil {
+                    ip, bits = ip4, 32
+                }
+                nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+                continue
+            }
+        } else if _, n, err := net.ParseCIDR(p); err == nil {
+            nets = append(nets, n)
+            continue
+        }
+        logger.Printf("Ignoring invalid proxy address %q\n", p)
+    }
+    return nets
+}
+
+// isTrustedProxy reports whether ip is one of the configured trusted proxies.
+func (s *Server) isTrustedProxy(ip net.IP) bool {
+    if ip == nil {
+        return false
+    }
+    s.trustedProxiesOnce.Do(func() {
+        s.trustedProxies = parseProxyList(s.Config.TrustedProxies, s.Logger)
+    })
+    for _, n := range s.trustedProxies {
+        if n.Contains(ip) {
+            return true
+        }
+    }
+    return false
+}
+
+// fromTrustedProxy reports whether the forwarding headers of req may be
+// honored: it arrived over SCGI or FastCGI, or directly from a trusted proxy.
+func (s *Server) fromTrustedProxy(req *http.Request) bool {
+    if gw, _ := req.Context().Value(gatewayKey{}).(bool); gw {
+        return true
+    }
+    host, _, err := net.SplitHostPort(req.RemoteAddr)
+    if err != nil {
+        host = req.RemoteAddr
+    }
+    return s.isTrustedProxy(net.ParseIP(host))
+}
+
+// a hop of a forwarded request, as reported by the proxy that received it
+type forwardedHop struct {
+    addr  string
+    proto string
+    host  string
+}
+
+// forwardedHops returns the hops recorded in the Forwarded header or,
+// if there is none, in the X-Forwarded-For, X-Forwarded-Proto and
+// X-Forwarded-Host or X-Real-IP headers, from the client to the last proxy.
+func forwardedHops(req *http.Request) []forwardedHop {
+    var hops []forwardedHop
+    for _, header := range req.Header["Forwarded"] {
+        for _, element := range strings.Split(header, ",") {
+            var hop forwardedHop
+            for _, pair := range strings.Split(element, ";") {
+                eq := strings.IndexByte(pair, '=')
+                if eq < 0 {
+                    continue
+                }
+                value := strings.Trim(strings.TrimSpace(pair[eq+1:]), `"`)
+                switch strings.ToLower(strings.TrimSpace(pair[:eq])) {
+                case "for":
+                    hop.addr = stripPort(value)
+                case "proto":
+                    hop.proto = strings.ToLower(value)
+                case "host":
+                    hop.host = value
+                }
+            }
+            hops = append(hops, hop)
+        }
+    }
+    if len(hops) > 0 {
+        return hops
+    }
+
+    addrs := splitHeaderList(req.Header["X-Forwarded-For"])
+    if len(addrs) == 0 {
+        if ip := strings.TrimSpace(req.Header.Get("X-Real-Ip")); ip != "" {
+            addrs = []string{ip}
+        }
+    }
+    protos := splitHeaderList(req.Header["X-Forwarded-Proto"])
+    hosts := splitHeaderList(req.Header["X-Forwarded-Host"])
+    for i, addr := range addrs {
+        hop := forwardedHop{addr: stripPort(addr)}
+        //the lists either line up with the addresses or hold a single value
+        if len(protos) == len(addrs) {
+            hop.proto = strings.ToLower(protos[i])
+        } else if len(protos) == 1 {
+            hop.proto = strings.ToLower(protos[0])
+        }
+        if len(hosts) == len(addrs) {
+            hop.host = hosts[i]
+        } else if len(hosts) == 1 {
+            hop.host = hosts[0]
+        }
+        hops = append(hops, hop)
+    }
+    return hops
+}
+
+func splitHeaderList(values []string) []string {
+    var list []string
+    for _, v := range values {
+        for _, item := range strings.Split(v, ",") {
+            if item = strings.TrimSpace(item); item != "" {
+                list = append(list, item)
+            }
+        }
+    }
+    return list
+}
+
+// stripPort removes the port and IPv6 brackets from an address.
+func stripPort(addr string) string {
+    if host, _, err := net.SplitHostPort(addr); err == nil {
+        return host
+    }
+    return strings.Trim(addr, "[]")
+}
+
+// resolveForwarded determines the client address, scheme and host of the
+// request. Forwarding headers are followed from the nearest hop towards
+// the client for as long as the hops are trusted proxies.
+func (ctx *Context) resolveForwarded() {
+    if ctx.forwarded != nil {
+        return
+    }
+    req := ctx.Request
+    client := forwardedHop{addr: stripPort(req.RemoteAddr), proto: "http", host: req.Host}
+    if req.TLS != nil {
+        client.proto = "https"
+    }
+    if ctx.Server.isTrustedProxy(net.ParseIP(client.addr)) {
+        hops := forwardedHops(req)
+        for i := len(hops) - 1; i >= 0; i-- {
+            hop := hops[i]
+            if hop.addr != "" {
+                client.addr = hop.addr
+            }
+            if hop.proto == "http" || hop.proto == "https" {
+                client.proto = hop.proto
+            }
+            if hop.host != "" {
+                client.host = hop.host
+            }
+            if !ctx.Server.isTrustedProxy(net.ParseIP(client.addr)) {
+                break
+            }
+        }
+    }
+    ctx.forwarded = &client
+}
+
+// ClientIP returns the IP address of the client. For requests through
+// trusted proxies it is taken from the Forwarded, X-Forwarded-For or
+// X-Real-IP headers.
+func (ctx *Context) ClientIP() string {
+    ctx.resolveForwarded()
+    return ctx.forwarded.addr
+}
+
+// Scheme returns "https" or "http", the scheme the client used. For
+// requests through trusted proxies it is taken from the Forwarded or
+// X-Forwarded-Proto headers.
+func (ctx *Context) Scheme() string {
+    ctx.resolveForwarded()
+    return ctx.forwarded.proto
+}
+
+// Host returns the host the client requested. For requests through
+// trusted proxies it is taken from the Forwarded or X-Forwarded-Host headers.
+func (ctx *Context) Host() string {
+    ctx.resolveForwarded()
+    return ctx.forwarded.host
+}
@@ -0,0 +1,335 @@
+package web
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "crypto/tls"
+    "encoding/binary"
+    "errors"
+    "hash/crc32"
+    "io"
+    "net"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// ProxyProtocolConfig enables the HAProxy PROXY protocol on the listeners
+// of a server, so that connections relayed by a TCP load balancer report
+// the address of the original client.
+type ProxyProtocolConfig struct {
+    // TrustedSources lists the addresses or CIDR ranges of the load
+    // balancers. Connections from other peers are rejected. It is
+    // required for TCP listeners, since any peer that may send a header
+    // can claim any client address; on Unix sockets, it is left to the
+    // permissions of the socket who may connect.
+    TrustedSources []string
+    // AllowMissing accepts connections from trusted sources that don't
+    // start with a PROXY header, such as health checks. By default they
+    // are rejected.
+    AllowMissing bool
+    // HeaderTimeout is how long to wait for the header. Defaults to 5 seconds.
+    HeaderTimeout time.Duration
+}
+
+// Types of the TLV fields of PROXY protocol version 2 headers.
+const (
+    ProxyTLVALPN      = 0x01
+    ProxyTLVAuthority = 0x02
+    ProxyTLVCRC32C    = 0x03
+    ProxyTLVNoop      = 0x04
+    ProxyTLVUniqueID  = 0x05
+    ProxyTLVSSL       = 0x20
+    ProxyTLVNetNS     = 0x30
+)
+
+// A ProxyHeader is the PROXY protocol header a connection started with.
+type ProxyHeader struct {
+    Version int
+    // Local is true for connections the proxy made on its own behalf,
+    // such as health checks; they carry no addresses.
+    Local       bool
+    Source      net.Addr
+    Destination net.Addr
+    // TLVs holds the type-length-value fields of a version 2 header.
+    TLVs map[byte][]byte
+}
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errProxyHeader = errors.New("invalid PROXY protocol header")
+
+// listen announces on the network address, wrapping the listener to
+// decode PROXY protocol headers if Config.ProxyProtocol is set.
+func (s *Server) listen(network string, addr string) (net.Listener, error) {
+    l, err := net.Listen(network, addr)
+    if err != nil || s.Config.ProxyProtocol == nil {
+        return l, err
+    }
+    c := *s.Config.ProxyProtocol
+    if c.HeaderTimeout == 0 {
+        c.HeaderTimeout = 5 * time.Second
+    }
+    trusted := parseProxyList(c.TrustedSources, s.Logger)
+    if len(trusted) == 0 && network != "unix" {
+        l.Close()
+        return nil, errors.New("web: PROXY protocol requires TrustedSources")
+    }
+    return &proxyListener{Listener: l, config: c, trusted: trusted, s: s}, nil
+}
+
+type proxyListener struct {
+    net.Listener
+    config  ProxyProtocolConfig
+    trusted []*net.IPNet
+    s       *Server
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+    for {
+        conn, err := l.Listener.Accept()
+        if err != nil {
+            return nil, err
+        }
+        if len(l.trusted) > 0 {
+            ip := net.ParseIP(stripPort(conn.RemoteAddr().String()))
+            trusted := false
+            for _, n := range l.trusted {
+                if ip != nil && n.Contains(ip) {
+                    trusted = true
+                }
+            }
+            if !trusted {
+                l.s.Logger.Println("PROXY protocol: rejected connection from untrusted source ", conn.RemoteAddr())
+                conn.Close()
+                continue
+            }
+        }
+        //the header is read lazily, in the goroutine serving the connection
+        return &proxyConn{Conn: conn, l: l}, nil
+    }
+}
+
+// proxyConn is a connection that starts with a PROXY protocol header.
+type proxyConn struct {
+    net.Conn
+    l      *proxyListener
+    once   sync.Once
+    r      *bufio.Reader
+    header *ProxyHeader
+    err    error
+}
+
+func (c *proxyConn) init() {
+    c.once.Do(func() {
+        c.r = bufio.NewReader(c.Conn)
+        c.Conn.SetReadDeadline(time.Now().Add(c.l.config.HeaderTimeout))
+        c.header, c.err = readProxyHeader(c.r)
+        c.Conn.SetReadDeadline(time.Time{})
+        if c.err == nil && c.header == nil && !c.l.config.AllowMissing {
+            c.err = errors.New("missing PROXY protocol header")
+        }
+        if c.err != nil {
+            c.l.s.Logger.Printf("PROXY protocol: %v from %s\n", c.err, c.Conn.RemoteAddr())
+            c.Conn.Close()
+        }
+    })
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+    c.init()
+    if c.err != nil {
+        return 0, c.err
+    }
+    return c.r.Read(p)
+}
+
+// RemoteAddr returns the address of the original client.
+func (c *proxyConn) RemoteAddr() net.Addr {
+    c.init()
+    if c.header != nil && c.header.Source != nil {
+        return c.header.Source
+    }
+    return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the address the original client connected to.
+func (c *proxyConn) LocalAddr() net.Addr {
+    c.init()
+    if c.header != nil && c.header.Destination != nil {
+        return c.header.Destination
+    }
+    return c.Conn.LocalAddr()
+}
+
+// readProxyHeader reads a version 1 or 2 header. It returns nil if the
+// stream doesn't start with one.
+func readProxyHeader(r *bufio.Reader) (*ProxyHeader, error) {
+    b, err := r.Peek(1)
+    if err != nil {
+        return nil, err
+    }
+    switch b[0] {
+    case 'P':
+        if b, err := r.Peek(6); err == nil && string(b) == "PROXY " {
+            return readProxyV1(r)
+        }
+    case '\r':
+        if b, err := r.Peek(len(proxyV2Signature)); err == nil && bytes.Equal(b, proxyV2Signature) {
+            return readProxyV2(r)
+        }
+    }
+    return nil, nil
+}
+
+func readProxyV1(r *bufio.Reader) (*ProxyHeader, error) {
+    //the longest version 1 header is 107 bytes
+    var line []byte
+    for len(line) < 107 {
+        c, err := r.ReadByte()
+        if err != nil {
+            return nil, err
+        }
+        line = append(line, c)
+        if c == '\n' {
+            break
+        }
+    }
+    if !bytes.HasSuffix(line, []byte("\r\n")) {
+        return nil, errProxyHeader
+    }
+    fields := strings.Split(string(line[:len(line)-2]), " ")
+    h := &ProxyHeader{Version: 1}
+    if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+        return h, nil
+    }
+    if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+        return nil, errProxyHeader
+    }
+    src, dst := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+    sport, err1 := strconv.ParseUint(fields[4], 10, 16)
+    dport, err2 := strconv.ParseUint(fields[5], 10, 16)
+    if src == nil || dst == nil || err1 != nil || err2 != nil || (src.To4() != nil) != (fields[1] == "TCP4") {
+        return nil, errProxyHeader
+    }
+    h.Source = &net.TCPAddr{IP: src, Port: int(sport)}
+    h.Destination = &net.TCPAddr{IP: dst, Port: int(dport)}
+    return h, nil
+}
+
+func readProxyV2(r *bufio.Reader) (*ProxyHeader, error) {
+    fixed := make([]byte, 16)
+    if _, err := io.ReadFull(r, fixed); err != nil {
+        return nil, err
+    }
+    if fixed[12]>>4 != 2 {
+        return nil, errProxyHeader
+    }
+    body := make([]byte, binary.BigEndian.Uint16(fixed[14:]))
+    if _, err := io.ReadFull(r, body); err != nil {
+        return nil, err
+    }
+    h := &ProxyHeader{Version: 2, TLVs: map[byte][]byte{}}
+    switch fixed[12] & 0xf {
+    case 0:
+        h.Local = true
+    case 1:
+    default:
+        return nil, errProxyHeader
+    }
+
+    var addrLen int
+    family, proto := fixed[13]>>4, fixed[13]&0xf
+    switch family {
+    case 0:
+        addrLen = 0
+    case 1:
+        addrLen = 12
+    case 2:
+        addrLen = 36
+    case 3:
+        addrLen = 216
+    default:
+        return nil, errProxyHeader
+    }
+    if len(body) < addrLen {
+        return nil, errProxyHeader
+    }
+    if !h.Local && (family == 1 || family == 2) {
+        n := 4
+        if family == 2 {
+            n = 16
+        }
+        src, dst := net.IP(body[:n]), net.IP(body[n:2*n])
+        sport := int(binary.BigEndian.Uint16(body[2*n:]))
+        dport := int(binary.BigEndian.Uint16(body[2*n+2:]))
+        if proto == 2 {
+            h.Source = &net.UDPAddr{IP: src, Port: sport}
+            h.Destination = &net.UDPAddr{IP: dst, Port: dport}
+        } else {
+            h.Source = &net.TCPAddr{IP: src, Port: sport}
+            h.Destination = &net.TCPAddr{IP: dst, Port: dport}
+        }
+    } else if !h.Local && family == 3 {
+        h.Source = &net.UnixAddr{Name: string(bytes.TrimRight(body[:108], "\x00")), Net: "unix"}
+        h.Destination = &net.UnixAddr{Name: string(bytes.TrimRight(body[108:216], "\x00")), Net: "unix"}
+    }
+
+    tlvs := body[addrLen:]
+    for len(tlvs) > 0 {
+        if len(tlvs) < 3 {
+            return nil, errProxyHeader
+        }
+        n := int(binary.BigEndian.Uint16(tlvs[1:]))
+        if len(tlvs) < 3+n {
+            return nil, errProxyHeader
+        }
+        if tlvs[0] == ProxyTLVCRC32C {
+            if n != 4 {
+                return nil, errProxyHeader
+            }
+            //the checksum covers the whole header with the checksum field zeroed
+            sum := binary.BigEndian.Uint32(tlvs[3:])
+            zeroed := append(append([]byte{}, fixed...), body...)
+            field := zeroed[len(fixed)+len(body)-len(tlvs)+3:]
+            copy(field[:4], []byte{0, 0, 0, 0})
+            if crc32.Checksum(zeroed, crc32.MakeTable(crc32.Castagnoli)) != sum {
+                return nil, errors.New("PROXY protocol header checksum mismatch")
+            }
+        }
+        h.TLVs[tlvs[0]] = tlvs[3 : 3+n]
+        tlvs = tlvs[3+n:]
+    }
+    return h, nil
+}
+
+type connKey struct{}
+
+// serveHTTP serves HTTP requests on l, remembering the connection of each
+// request so that its PROXY protocol header can be inspected.
+func (s *Server) serveHTTP(l net.Listener, handler http.Handler) error {
+    srv := &http.Server{
+        Handler: handler,
+        ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+            return context.WithValue(ctx, connKey{}, c)
+        },
+    }
+    return srv.Serve(l)
+}
+
+// ProxyHeader returns the PROXY protocol header of the connection the
+// request arrived on, or nil.
+func (ctx *Context) ProxyHeader() *ProxyHeader {
+    conn, _ := ctx.Request.Context().Value(connKey{}).(net.Conn)
+    if tc, ok := conn.(*tls.Conn); ok {
+        conn = tc.NetConn()
+    }
+    if pc, ok := conn.(*proxyConn); ok {
+        pc.init()
+        return pc.header
+    }
+    return nil
+}
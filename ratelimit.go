@@ -0,0 +1,316 @@
+package web
+
+import (
+    "container/list"
+    "hash/fnv"
+    "math"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// The rate limiting algorithms.
+const (
+    // TokenBucket refills Requests tokens evenly over each Window, up to
+    // Burst tokens, and each request takes one.
+    TokenBucket = "token-bucket"
+    // SlidingWindow allows Requests in any Window, estimated from the
+    // counts of the current and previous fixed windows.
+    SlidingWindow = "sliding-window"
+)
+
+// A RateLimit describes how many requests a client may make.
+type RateLimit struct {
+    Requests  int
+    Window    time.Duration
+    Algorithm string
+    // Burst is the bucket size of the token bucket algorithm. Defaults to Requests.
+    Burst int
+}
+
+// RateLimitStatus is the outcome of a rate limit check.
+type RateLimitStatus struct {
+    Allowed   bool
+    Limit     int
+    Remaining int
+    // Reset is the time until the limit is fully restored.
+    Reset time.Duration
+    // RetryAfter is the time until the next request would be allowed.
+    RetryAfter time.Duration
+}
+
+// A RateLimitStore counts requests against rate limits. A store backed by
+// a shared database lets several servers enforce common limits; it must
+// apply the algorithm atomically.
+type RateLimitStore interface {
+    Allow(key string, limit *RateLimit, now time.Time) (RateLimitStatus, error)
+}
+
+// RateLimitConfig is the configuration for the RateLimiter middleware.
+type RateLimitConfig struct {
+    Limit RateLimit
+    // Name distinguishes limiters that share a store.
+    Name string
+    // Key returns the client a request is counted against. Requests for
+    // which it returns an empty string are not limited. Defaults to KeyByIP.
+    Key func(ctx *Context) string
+    // Store defaults to a new MemoryStore.
+    Store RateLimitStore
+    // ErrorHandler is called for requests over the limit, after the
+    // rate limit headers are set. The default responds with 429.
+    ErrorHandler func(ctx *Context, status RateLimitStatus)
+}
+
+// RateLimiter returns a middleware that limits the rate of requests of
+// each client. Responses carry RateLimit-Limit, RateLimit-Remaining and
+// RateLimit-Reset headers, and rejected requests a Retry-After header.
+// The config is required, and RateLimiter panics if it is nil or its
+// limit has no positive Requests and Window.
+func RateLimiter(config *RateLimitConfig) Middleware {
+    if config == nil {
+        panic("web: RateLimiter requires a config")
+    }
+    c := *config
+    if c.Limit.Requests <= 0 || c.Limit.Window <= 0 {
+        panic("web: invalid rate limit " + strconv.Itoa(c.Limit.Requests) + " per " + c.Limit.Window.String())
+    }
+    if c.Limit.Algorithm == "" {
+        c.Limit.Algorithm = TokenBucket
+    }
+    if c.Limit.Burst == 0 {
+        c.Limit.Burst = c.Limit.Requests
+    }
+    if c.Key == nil {
+        c.Key = KeyByIP
+    }
+    if c.Store == nil {
+        c.Store = NewMemoryStore(0)
+    }
+    if c.ErrorHandler == nil {
+        c.ErrorHandler = func(ctx *Context, status RateLimitStatus) {
+            ctx.Abort(429, "Too Many Requests")
+        }
+    }
+    policy := strconv.Itoa(c.Limit.Requests) + ";w=" + strconv.Itoa(int(c.Limit.Window/time.Second))
+
+    return func(ctx *Context, next func()) {
+        key := c.Key(ctx)
+        if key == "" {
+            next()
+            return
+        }
+        status, err := c.Store.Allow(c.Name+"|"+key, &c.Limit, time.Now())
+        if err != nil {
+            //fail open, so an unavailable store doesn't take the site down
+            ctx.Server.Logger.Println("Rate limit store error: ", err)
+            next()
+            return
+        }
+        ctx.SetHeader("RateLimit-Policy", policy, true)
+        ctx.SetHeader("RateLimit-Limit", strconv.Itoa(status.Limit), true)
+        ctx.SetHeader("RateLimit-Remaining", strconv.Itoa(status.Remaining), true)
+        ctx.SetHeader("RateLimit-Reset", strconv.Itoa(ceilSeconds(status.Reset)), true)
+        if !status.Allowed {
+            ctx.SetHeader("Retry-After", strconv.Itoa(ceilSeconds(status.RetryAfter)), true)
+            c.ErrorHandler(ctx, status)
+            return
+        }
+        next()
+    }
+}
+
+func ceilSeconds(d time.Duration) int {
+    return int(math.Ceil(d.Seconds()))
+}
+
+// KeyByIP counts requests against the client IP address.
+func KeyByIP(ctx *Context) string {
+    return ctx.ClientIP()
+}
+
+// KeyByUser counts requests against the authenticated user, and
+// anonymous requests against the client IP address.
+func KeyByUser(ctx *Context) string {
+    if user := ctx.User(); user != "" {
+        return "user:" + user
+    }
+    return KeyByIP(ctx)
+}
+
+// KeyByHeader returns a key function that counts requests against the
+// value of a request header, such as an API key. Requests without the
+// header are counted against the client IP address.
+func KeyByHeader(name string) func(ctx *Context) string {
+    return func(ctx *Context) string {
+        if v := ctx.Request.Header.Get(name); v != "" {
+            return "header:" + v
+        }
+        return KeyByIP(ctx)
+    }
+}
+
+const memoryStoreShards = 32
+
+// MemoryStore is an in-process RateLimitStore. Keys are spread over
+// shards with separate locks, and entries are evicted once their limit
+// is fully restored, or when a shard is over capacity.
+type MemoryStore struct {
+    shards   [memoryStoreShards]memoryShard
+    capacity int
+}
+
+type memoryShard struct {
+    sync.Mutex
+    entries map[string]*list.Element
+    //most recently used entries first
+    lru   list.List
+    swept time.Time
+}
+
+type rateEntry struct {
+    key string
+    //token bucket
+    tokens float64
+    //sliding window
+    windowStart time.Time
+    count       int
+    prevCount   int
+
+    updated time.Time
+    expires time.Time
+}
+
+// NewMemoryStore returns a store that keeps at most about maxKeys keys.
+// If maxKeys is zero, 100000 is used.
+func NewMemoryStore(maxKeys int) *MemoryStore {
+    if maxKeys <= 0 {
+        maxKeys = 100000
+    }
+    m := &MemoryStore{capacity: (maxKeys + memoryStoreShards - 1) / memoryStoreShards}
+    for i := range m.shards {
+        m.shards[i].entries = map[string]*list.Element{}
+    }
+    return m
+}
+
+// Len returns the number of keys in the store.
+func (m *MemoryStore) Len() int {
+    n := 0
+    for i := range m.shards {
+        m.shards[i].Lock()
+        n += len(m.shards[i].entries)
+        m.shards[i].Unlock()
+    }
+    return n
+}
+
+func (m *MemoryStore) shard(key string) *memoryShard {
+    h := fnv.New32a()
+    h.Write([]byte(key))
+    return &m.shards[h.Sum32()%memoryStoreShards]
+}
+
+// Allow implements RateLimitStore.
+func (m *MemoryStore) Allow(key string, limit *RateLimit, now time.Time) (RateLimitStatus, error) {
+    shard := m.shard(key)
+    shard.Lock()
+    defer shard.Unlock()
+
+    if now.Sub(shard.swept) > limit.Window {
+        shard.sweep(now)
+    }
+    var e *rateEntry
+    if el, ok := shard.entries[key]; ok {
+        shard.lru.MoveToFront(el)
+        e = el.Value.(*rateEntry)
+    } else {
+        for len(shard.entries) >= m.capacity {
+            shard.remove(shard.lru.Back())
+        }
+        e = &rateEntry{key: key, tokens: float64(limit.Burst), windowStart: now, updated: now}
+        shard.entries[key] = shard.lru.PushFront(e)
+    }
+
+    var status RateLimitStatus
+    if limit.Algorithm == SlidingWindow {
+        status = e.slidingWindow(limit, now)
+    } else {
+        status = e.tokenBucket(limit, now)
+    }
+    e.expires = now.Add(status.Reset)
+    return status, nil
+}
+
+// sweep removes the entries whose limits are fully restored.
+func (shard *memoryShard) sweep(now time.Time) {
+    shard.swept = now
+    for _, el := range shard.entries {
+        if !now.Before(el.Value.(*rateEntry).expires) {
+            shard.remove(el)
+        }
+    }
+}
+
+func (shard *memoryShard) remove(el *list.Element) {
+    e := shard.lru.Remove(el).(*rateEntry)
+    delete(shard.entries, e.key)
+}
+
+func (e *rateEntry) tokenBucket(limit *RateLimit, now time.Time) RateLimitStatus {
+    rate := float64(limit.Requests) / limit.Window.Seconds() //tokens per second
+    burst := float64(limit.Burst)
+    e.tokens = math.Min(burst, e.tokens+now.Sub(e.updated).Seconds()*rate)
+    e.updated = now
+
+    status := RateLimitStatus{Limit: limit.Burst}
+    if e.tokens >= 1 {
+        e.tokens--
+        status.Allowed = true
+    } else {
+        status.RetryAfter = time.Duration((1 - e.tokens) / rate * float64(time.Second))
+    }
+    status.Remaining = int(e.tokens)
+    status.Reset = time.Duration((burst - e.tokens) / rate * float64(time.Second))
+    return status
+}
+
+func (e *rateEntry) slidingWindow(limit *RateLimit, now time.Time) RateLimitStatus {
+    elapsed := now.Sub(e.windowStart)
+    if elapsed >= limit.Window {
+        windows := int(elapsed / limit.Window)
+        if windows == 1 {
+            e.prevCount = e.count
+        } else {
+            e.prevCount = 0
+        }
+        e.count = 0
+        e.windowStart = e.windowStart.Add(time.Duration(windows) * limit.Window)
+        elapsed = now.Sub(e.windowStart)
+    }
+    e.updated = now
+    //weight the previous window by how much of it still overlaps the sliding window
+    weight := 1 - float64(elapsed)/float64(limit.Window)
+    estimate := float64(e.prevCount)*weight + float64(e.count)
+
+    status := RateLimitStatus{Limit: limit.Requests}
+    if estimate+1 <= float64(limit.Requests) {
+        e.count++
+        estimate++
+        status.Allowed = true
+    } else if e.prevCount > 0 && float64(e.count) < float64(limit.Requests) {
+        //wait until enough of the previous window has slid out
+        needed := (estimate + 1 - float64(limit.Requests)) / float64(e.prevCount)
+        status.RetryAfter = time.Duration(needed * float64(limit.Window))
+    } else {
+        status.RetryAfter = limit.Window - elapsed
+    }
+    status.Remaining = limit.Requests - int(math.Ceil(estimate))
+    if status.Remaining < 0 {
+        status.Remaining = 0
+    }
+    status.Reset = 2*limit.Window - elapsed
+    if e.count == 0 {
+        status.Reset = limit.Window - elapsed
+    }
+    return status
+}
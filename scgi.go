@@ -3,6 +3,7 @@ package web
 import (
     "bufio"
     "bytes"
+    "context"
     "errors"
     "fmt"
     "io"
@@ -134,7 +135,7 @@ func (s *Server) readScgiRequest(fd io.ReadWriteCloser) (*http.Request, error) {
     } else {
         httpReq.Body = &scgiBody{reader: reader, conn: fd}
     }
-    return httpReq, nil
+    return fromGateway(httpReq), nil
 }
 
 func (s *Server) handleScgiRequest(fd io.ReadWriteCloser) {
@@ -142,6 +143,9 @@ func (s *Server) handleScgiRequest(fd io.ReadWriteCloser) {
     if err != nil {
         s.Logger.Println("SCGI error: %q", err.Error())
     }
+    if conn, ok := fd.(net.Conn); ok && req != nil {
+        req = req.WithContext(context.WithValue(req.Context(), connKey{}, conn))
+    }
     sc := scgiConn{fd, req, make(map[string][]string), false}
     s.routeHandler(req, &sc)
     sc.finishRequest()
@@ -155,9 +159,9 @@ func (s *Server) listenAndServeScgi(addr string) error {
 
     //if the path begins with a "/", assume it's a unix address
     if strings.HasPrefix(addr, "/") {
-        l, err = net.Listen("unix", addr)
+        l, err = s.listen("unix", addr)
     } else {
-        l, err = net.Listen("tcp", addr)
+        l, err = s.listen("tcp", addr)
     }
 
     //save the listener so it can be closed
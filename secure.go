@@ -0,0 +1,163 @@
+package web
+
+import (
+    "crypto/rand"
+    "encoding/base64"
+    "encoding/json"
+    "io"
+    "io/ioutil"
+    "strconv"
+    "strings"
+)
+
+// SecureHeadersConfig is the configuration for the SecureHeaders middleware.
+// Headers whose fields are left empty are not sent.
+type SecureHeadersConfig struct {
+    // STSMaxAge is the max-age, in seconds, of the Strict-Transport-Security
+    // header. It is only sent on HTTPS requests.
+    STSMaxAge             int
+    STSIncludeSubdomains  bool
+    STSPreload            bool
+    ContentTypeNosniff    bool
+    FrameOptions          string
+    ReferrerPolicy        string
+    PermissionsPolicy     string
+    ContentSecurityPolicy string
+    // CSPReportOnly sends the policy as Content-Security-Policy-Report-Only,
+    // so violations are reported but not blocked.
+    CSPReportOnly bool
+    // ReportPath, if set, is the path of a built-in endpoint that collects
+    // CSP violation reports. It is added to the policy as its report-uri.
+    ReportPath string
+    // ReportHandler is called with each collected report. By default
+    // reports are written to the server log.
+    ReportHandler func(ctx *Context, report *CSPReport)
+}
+
+// CSPReport is a Content-Security-Policy violation report sent by a browser.
+type CSPReport struct {
+    DocumentURI        string `json:"document-uri"`
+    Referrer           string `json:"referrer"`
+    BlockedURI         string `json:"blocked-uri"`
+    ViolatedDirective  string `json:"violated-directive"`
+    EffectiveDirective string `json:"effective-directive"`
+    OriginalPolicy     string `json:"original-policy"`
+    Disposition        string `json:"disposition"`
+    SourceFile         string `json:"source-file"`
+    LineNumber         int    `json:"line-number"`
+    ColumnNumber       int    `json:"column-number"`
+    StatusCode         int    `json:"status-code"`
+    ScriptSample       string `json:"script-sample"`
+}
+
+// DefaultSecureHeaders is the configuration used by SecureHeaders(nil).
+// The policy's {nonce} placeholder is replaced by a fresh nonce on every request.
+var DefaultSecureHeaders = SecureHeadersConfig{
+    STSMaxAge:             31536000,
+    STSIncludeSubdomains:  true,
+    ContentTypeNosniff:    true,
+    FrameOptions:          "SAMEORIGIN",
+    ReferrerPolicy:        "strict-origin-when-cross-origin",
+    PermissionsPolicy:     "camera=(), microphone=(), geolocation=()",
+    ContentSecurityPolicy: "default-src 'self'; script-src 'self' 'nonce-{nonce}'; object-src 'none'; base-uri 'self'",
+}
+
+// SecureHeaders returns a middleware that sets security related headers on
+// every response. If the Content-Security-Policy contains the placeholder
+// {nonce}, a per-request nonce is generated and substituted, and is
+// available to templates through ctx.CSPNonce. A nil config uses
+// DefaultSecureHeaders.
+func SecureHeaders(config *SecureHeadersConfig) Middleware {
+    c := DefaultSecureHeaders
+    if config != nil {
+        c = *config
+    }
+
+    var sts string
+    if c.STSMaxAge > 0 {
+        sts = "max-age=" + strconv.Itoa(c.STSMaxAge)
+        if c.STSIncludeSubdomains {
+            sts += "; includeSubDomains"
+        }
+        if c.STSPreload {
+            sts += "; preload"
+        }
+    }
+    csp := c.ContentSecurityPolicy
+    if csp != "" && c.ReportPath != "" && !strings.Contains(csp, "report-uri") {
+        csp += "; report-uri " + c.ReportPath
+    }
+    cspHeader := "Content-Security-Policy"
+    if c.CSPReportOnly {
+        cspHeader = "Content-Security-Policy-Report-Only"
+    }
+    useNonce := strings.Contains(csp, "{nonce}")
+
+    return func(ctx *Context, next func()) {
+        if c.ReportPath != "" && ctx.Request.URL.Path == c.ReportPath && ctx.Request.Method == "POST" {
+            c.collectReport(ctx)
+            return
+        }
+
+        if sts != "" && ctx.Scheme() == "https" {
+            ctx.SetHeader("Strict-Transport-Security", sts, true)
+        }
+        if c.ContentTypeNosniff {
+            ctx.SetHeader("X-Content-Type-Options", "nosniff", true)
+        }
+        if c.FrameOptions != "" {
+            ctx.SetHeader("X-Frame-Options", c.FrameOptions, true)
+        }
+        if c.ReferrerPolicy != "" {
+            ctx.SetHeader("Referrer-Policy", c.ReferrerPolicy, true)
+        }
+        if c.PermissionsPolicy != "" {
+            ctx.SetHeader("Permissions-Policy", c.PermissionsPolicy, true)
+        }
+        if csp != "" {
+            policy := csp
+            if useNonce {
+                b := make([]byte, 16)
+                if _, err := rand.Read(b); err != nil {
+                    ctx.Server.Logger.Println("Error generating CSP nonce: ", err)
+                    ctx.Abort(500, "Server Error")
+                    return
+                }
+                ctx.cspNonce = base64.StdEncoding.EncodeToString(b)
+                policy = strings.Replace(policy, "{nonce}", ctx.cspNonce, -1)
+            }
+            ctx.SetHeader(cspHeader, policy, true)
+        }
+        next()
+    }
+}
+
+// collectReport reads a CSP violation report from the request body.
+func (c *SecureHeadersConfig) collectReport(ctx *Context) {
+    data, err := ioutil.ReadAll(io.LimitReader(ctx.Request.Body, 64*1024))
+    if err != nil {
+        ctx.Abort(400, "Bad Request")
+        return
+    }
+    var body struct {
+        Report *CSPReport `json:"csp-report"`
+    }
+    if err := json.Unmarshal(data, &body); err != nil || body.Report == nil {
+        ctx.Abort(400, "Bad Request")
+        return
+    }
+    if c.ReportHandler != nil {
+        c.ReportHandler(ctx, body.Report)
+    } else {
+        ctx.Server.Logger.Printf("CSP violation: %q blocked %q on %q\n",
+            body.Report.ViolatedDirective, body.Report.BlockedURI, body.Report.DocumentURI)
+    }
+    ctx.WriteHeader(204)
+}
+
+// CSPNonce returns the Content-Security-Policy nonce of the current request,
+// for use in the nonce attribute of inline scripts and styles. It returns an
+// empty string if the SecureHeaders middleware is not generating nonces.
+func (ctx *Context) CSPNonce() string {
+    return ctx.cspNonce
+}
@@ -3,7 +3,9 @@ package web
 import (
     "bytes"
     "crypto/tls"
+    "crypto/x509"
     "fmt"
+    "io/fs"
     "log"
     "net"
     "net/http"
@@ -14,6 +16,8 @@ import (
     "regexp"
     "runtime"
     "strconv"
+    "strings"
+    "sync"
     "time"
 )
 
@@ -25,14 +29,111 @@ type ServerConfig struct {
     CookieSecret string
     RecoverPanic bool
     Profiler     bool
+
+    // StaticFS lists filesystems, such as an embed.FS, that static files
+    // are served from before StaticDir, in priority order.
+    StaticFS []fs.FS
+    // ServeDotfiles allows static files whose name starts with a dot.
+    // StaticDeny lists glob patterns, such as "*.map" or "drafts/*", of
+    // static files that are not served. If nil, DefaultStaticDeny is used.
+    ServeDotfiles bool
+    StaticDeny    []string
+    // NoDefaultStaticDirs disables the 'static' directories next to the
+    // executable and in the working directory used when StaticDir is empty.
+    NoDefaultStaticDirs bool
+    // RoutesBeforeStatic makes routes take precedence over static files.
+    RoutesBeforeStatic bool
+    // CompressStatic enables gzip compression of static text files that
+    // have no precompressed .gz or .br version. Compressed files are cached
+    // in memory, up to CompressCacheSize bytes (default 16 MB).
+    CompressStatic    bool
+    CompressCacheSize int64
+    // StaticCacheSize enables an in-memory LRU cache of static files of
+    // up to StaticCacheSize bytes. Cached files are served without disk
+    // access and are checked for changes every StaticCachePoll, which
+    // defaults to 2 seconds.
+    StaticCacheSize int64
+    StaticCachePoll time.Duration
+
+    // ClientCAFile is a PEM bundle of CAs used by RunTLS to verify client
+    // certificates. Certificates are requested but optional unless
+    // ClientCertRequired is set.
+    ClientCAFile       string
+    ClientCertRequired bool
+    // ClientCertHeader is a request header in which a trusted proxy
+    // forwards the client certificate it verified, as URL-escaped PEM.
+    // The header is trusted as is: the proxy must always set or clear it,
+    // since a client could otherwise send any certificate it has seen.
+    // Forwarded certificates must also verify against ClientCAFile, which
+    // is not a defense against such a header.
+    ClientCertHeader string
+    // TrustedProxies lists the addresses or CIDR ranges of reverse proxies
+    // whose forwarding headers are honored. It is parsed when the first
+    // request arrives. The web server in front of SCGI and FastCGI is
+    // always trusted to forward client certificates.
+    TrustedProxies []string
+
+    // ACMEDirectory is the directory URL of the ACME server used by
+    // RunAutoTLS. Defaults to LetsEncryptURL.
+    ACMEDirectory string
+    ACMEEmail     string
+    // ACMECacheDir is where RunAutoTLS keeps its account key and
+    // certificates. Defaults to "acme-cache".
+    ACMECacheDir string
+    // ACMEChallenge is "http-01" (the default) or "tls-alpn-01".
+    ACMEChallenge    string
+    ACMEPollInterval time.Duration
+    // AutoTLSAddr and AutoTLSHTTPAddr are the HTTPS and HTTP listen
+    // addresses of RunAutoTLS. They default to ":443" and ":80"; an
+    // AutoTLSHTTPAddr of "-" disables the HTTP listener.
+    AutoTLSAddr     string
+    AutoTLSHTTPAddr string
+
+    // ProxyProtocol, if set, makes every listener expect HAProxy PROXY
+    // protocol headers.
+    ProxyProtocol *ProxyProtocolConfig
+
+    // MaxBodySize is the largest request body, in bytes, that is read
+    // before the handler runs. Larger requests are answered with 413.
+    // Zero means no limit. Routes can override it with BodyLimit.
+    MaxBodySize int64
+    // MultipartMemory is how many bytes of a multipart form are held in
+    // memory. Uploaded files beyond it are written to os.TempDir(), as by
+    // http.Request.ParseMultipartForm. It defaults to 32 MB.
+    MultipartMemory int64
+    // MaxFormFields and MaxFormFiles limit the number of values and files
+    // in a request. They default to 1000 and 100.
+    MaxFormFields int
+    MaxFormFiles  int
 }
 
 // Server represents a web.go server.
 type Server struct {
-    Config *ServerConfig
-    routes []route
-    Logger *log.Logger
-    Env    map[string]interface{}
+    Config     *ServerConfig
+    routes     []route
+    middleware []Middleware
+    mounts     []*StaticMount
+    cacheRules []cacheRule
+    Logger     *log.Logger
+    Env        map[string]interface{}
+    // Policy decides whether a principal may access a route that has
+    // access requirements. If nil, DefaultPolicy is used.
+    Policy Policy
+    //client CAs loaded from Config.ClientCAFile
+    clientCAs     *x509.CertPool
+    clientCAsErr  error
+    clientCAsOnce sync.Once
+    //parsed Config.TrustedProxies
+    trustedProxies     []*net.IPNet
+    trustedProxiesOnce sync.Once
+    //certificates managed by RunAutoTLS
+    acme *autoCert
+    //static files compressed on the fly
+    gzipCache byteCache
+    //static files cached in memory
+    fileCache byteCache
+    //fingerprinted asset URLs computed by Fingerprint
+    assets assetMap
     //save the listener so it can be closed
     l   net.Listener
 }
@@ -55,14 +156,37 @@ func (s *Server) initServer() {
     }
 }
 
+// defaultContentType is the content type of the responses of handlers.
+const defaultContentType = "text/html; charset=utf-8"
+
 type route struct {
-    r       string
-    cr      *regexp.Regexp
-    method  string
-    handler reflect.Value
+    r          string
+    cr         *regexp.Regexp
+    method     string
+    handler    reflect.Value
+    middleware []Middleware
+    access     []*Access
+    maxBody    int64
 }
 
 func (s *Server) addRoute(r string, method string, handler interface{}) {
+    s.addGroupRoute(nil, r, method, handler)
+}
+
+// addGroupRoute adds a route that uses the prefix, middleware and access
+// requirements of group g, which may be nil.
+func (s *Server) addGroupRoute(g *RouteGroup, r string, method string, handler interface{}) {
+    var middleware []Middleware
+    var access []*Access
+    var maxBody int64
+    if g != nil {
+        r = g.prefix + r
+        middleware = make([]Middleware, len(g.middleware))
+        copy(middleware, g.middleware)
+        access = g.access
+        maxBody = g.maxBody
+    }
+
     cr, err := regexp.Compile(r)
     if err != nil {
         s.Logger.Printf("Error in route regex %q\n", r)
@@ -70,13 +194,43 @@ func (s *Server) addRoute(r string, method string, handler interface{}) {
     }
 
     if fv, ok := handler.(reflect.Value); ok {
-        s.routes = append(s.routes, route{r, cr, method, fv})
+        s.routes = append(s.routes, route{r, cr, method, fv, middleware, access, maxBody})
     } else {
         fv := reflect.ValueOf(handler)
-        s.routes = append(s.routes, route{r, cr, method, fv})
+        s.routes = append(s.routes, route{r, cr, method, fv, middleware, access, maxBody})
     }
 }
 
+// match returns the submatches of the route regex if it matches the
+// whole of requestPath, or nil otherwise.
+func (r *route) match(requestPath string) []string {
+    if !r.cr.MatchString(requestPath) {
+        return nil
+    }
+    match := r.cr.FindStringSubmatch(requestPath)
+
+    if len(match[0]) != len(requestPath) {
+        return nil
+    }
+    return match
+}
+
+// routeMethods returns the http methods of the routes that match requestPath,
+// in the order they were added.
+func (s *Server) routeMethods(requestPath string) []string {
+    var methods []string
+    seen := map[string]bool{}
+    for i := range s.routes {
+        route := &s.routes[i]
+        if seen[route.method] || route.match(requestPath) == nil {
+            continue
+        }
+        seen[route.method] = true
+        methods = append(methods, route.method)
+    }
+    return methods
+}
+
 // ServeHTTP is the interface method for Go's http server package
 func (s *Server) ServeHTTP(c http.ResponseWriter, req *http.Request) {
     s.Process(c, req)
@@ -127,12 +281,12 @@ func (s *Server) Run(addr string) {
 
     s.Logger.Printf("web.go serving %s\n", addr)
 
-    l, err := net.Listen("tcp", addr)
+    l, err := s.listen("tcp", addr)
     if err != nil {
         log.Fatal("ListenAndServe:", err)
     }
     s.l = l
-    err = http.Serve(s.l, mux)
+    err = s.serveHTTP(s.l, mux)
     s.l.Close()
 }
 
@@ -153,16 +307,21 @@ func (s *Server) RunScgi(addr string) {
 // RunTLS starts the web application and serves HTTPS requests for s.
 func (s *Server) RunTLS(addr string, config *tls.Config) error {
     s.initServer()
+    config, err := s.clientAuthConfig(config)
+    if err != nil {
+        log.Fatal("TLS:", err)
+        return err
+    }
     mux := http.NewServeMux()
     mux.Handle("/", s)
-    l, err := tls.Listen("tcp", addr, config)
+    l, err := s.listen("tcp", addr)
     if err != nil {
         log.Fatal("Listen:", err)
         return err
     }
 
-    s.l = l
-    return http.Serve(s.l, mux)
+    s.l = tls.NewListener(l, config)
+    return s.serveHTTP(s.l, mux)
 }
 
 // Close stops server s.
@@ -219,124 +378,189 @@ func requiresContext(handlerType reflect.Type) bool {
 
 // tryServingFile attempts to serve a static file, and returns
 // whether or not the operation is successful.
-// It checks the following directories for the file, in order:
-// 1) Config.StaticDir
-// 2) The 'static' directory in the parent directory of the executable.
-// 3) The 'static' directory in the current working directory
-func (s *Server) tryServingFile(name string, req *http.Request, w http.ResponseWriter) bool {
-    //try to serve a static file
-    if s.Config.StaticDir != "" {
-        staticFile := path.Join(s.Config.StaticDir, name)
-        if fileExists(staticFile) {
-            http.ServeFile(w, req, staticFile)
-            return true
-        }
-    } else {
-        for _, staticDir := range defaultStaticDirs {
-            staticFile := path.Join(staticDir, name)
-            if fileExists(staticFile) {
-                http.ServeFile(w, req, staticFile)
+func (s *Server) tryServingFile(ctx *Context, name string) bool {
+    req, w := ctx.Request, ctx.ResponseWriter
+    cacheControl := s.cacheControl(name)
+    if original, ok := s.assetOriginal(name); ok {
+        name = original
+        cacheControl = immutableCacheControl
+    }
+    //let http.ServeFileFS redirect requests for index.html
+    cacheable := s.Config.StaticCacheSize > 0 && !strings.HasSuffix(req.URL.Path, "/index.html")
+    if cacheable {
+        if entry, ok := s.fileCache.lookup(name); ok {
+            if !s.checkSignature(ctx, entry.mount) {
                 return true
             }
+            setCacheControl(w, cacheControl)
+            s.serveCachedFile(w, req, entry)
+            return true
         }
     }
-    return false
+    m, fsys, file, ok := s.findStaticFile(name)
+    if !ok {
+        return false
+    }
+    //a shorter mount than the one checked by dispatch may hold the file
+    if !s.checkSignature(ctx, m) {
+        return true
+    }
+    setCacheControl(w, cacheControl)
+    if cacheable {
+        if entry := s.cacheStaticFile(name, m, fsys, file); entry != nil {
+            s.serveCachedFile(w, req, entry)
+            return true
+        }
+    }
+    s.serveFile(w, req, fsys, file)
+    return true
+}
+
+func setCacheControl(w http.ResponseWriter, cacheControl string) {
+    if cacheControl != "" && w.Header().Get("Cache-Control") == "" {
+        w.Header().Set("Cache-Control", cacheControl)
+    }
 }
 
 // the main route handler in web.go
 func (s *Server) routeHandler(req *http.Request, w http.ResponseWriter) {
     requestPath := req.URL.Path
-    ctx := Context{req, map[string]string{}, s, w}
+    ctx := Context{Request: req, Params: map[string]string{}, Server: s, ResponseWriter: w}
 
     //log the request
     var logEntry bytes.Buffer
-    fmt.Fprintf(&logEntry, "\033[32;1m%s %s\033[0m", req.Method, requestPath)
+    fmt.Fprintf(&logEntry, "%s \033[32;1m%s %s\033[0m", ctx.ClientIP(), req.Method, requestPath)
 
-    //ignore errors from ParseForm because it's usually harmless.
-    req.ParseForm()
-    if len(req.Form) > 0 {
-        for k, v := range req.Form {
+    //the body is parsed lazily, by ctx.ParseForm
+    if query := ctx.queryValues(); len(query) > 0 {
+        for k, v := range query {
             ctx.Params[k] = v[0]
         }
         fmt.Fprintf(&logEntry, "\n\033[37;1mParams: %v\033[0m\n", ctx.Params)
     }
     ctx.Server.Logger.Print(logEntry.String())
 
+    defer ctx.removeUploads()
+    if !s.limitBody(&ctx) {
+        return
+    }
+
     //set some default headers
     ctx.SetHeader("Server", "web.go", true)
     tm := time.Now().UTC()
     ctx.SetHeader("Date", webTime(tm), true)
 
-    if req.Method == "GET" || req.Method == "HEAD" {
-        if s.tryServingFile(requestPath, req, w) {
+    if s.serveACMEChallenge(&ctx) {
+        return
+    }
+    runMiddleware(&ctx, s.middleware, func() { s.dispatch(&ctx) })
+}
+
+// dispatch serves a static file or invokes the first matching route
+// handler. It runs after the server's middleware.
+func (s *Server) dispatch(ctx *Context) {
+    req := ctx.Request
+    requestPath := req.URL.Path
+    isGet := req.Method == "GET" || req.Method == "HEAD"
+
+    if isGet && !s.checkMountSignature(ctx) {
+        return
+    }
+
+    if isGet && !s.Config.RoutesBeforeStatic {
+        if s.tryServingFile(ctx, requestPath) {
             return
         }
     }
 
     //Set the default content-type
-    ctx.SetHeader("Content-Type", "text/html; charset=utf-8", true)
+    ctx.SetHeader("Content-Type", defaultContentType, true)
 
-    for i := 0; i < len(s.routes); i++ {
-        route := s.routes[i]
-        cr := route.cr
-        //if the methods don't match, skip this handler (except HEAD can be used in place of GET)
-        if req.Method != route.method && !(req.Method == "HEAD" && route.method == "GET") {
-            continue
-        }
+    if route, match := s.findRoute(req.Method, requestPath); route != nil {
+        runMiddleware(ctx, route.middleware, func() {
+            if s.authorize(ctx, route.access) {
+                s.callHandler(ctx, route.handler, match[1:])
+            }
+        })
+        return
+    }
 
-        if !cr.MatchString(requestPath) {
-            continue
+    if isGet && s.Config.RoutesBeforeStatic {
+        if s.tryServingFile(ctx, requestPath) {
+            return
         }
-        match := cr.FindStringSubmatch(requestPath)
+    }
 
-        if len(match[0]) != len(requestPath) {
-            continue
+    // try serving index.html or index.htm
+    if isGet {
+        if s.tryServingFile(ctx, path.Join(requestPath, "index.html")) {
+            return
+        } else if s.tryServingFile(ctx, path.Join(requestPath, "index.htm")) {
+            return
+        } else if s.serveMountFallback(ctx) {
+            return
         }
+    }
+    ctx.Abort(404, "Page not found")
+}
 
-        var args []reflect.Value
-        handlerType := route.handler.Type()
-        if requiresContext(handlerType) {
-            args = append(args, reflect.ValueOf(&ctx))
+// findRoute returns the first route that handles method and path, and the
+// submatches of its pattern.
+func (s *Server) findRoute(method string, path string) (*route, []string) {
+    for i := 0; i < len(s.routes); i++ {
+        route := &s.routes[i]
+        //if the methods don't match, skip this handler (except HEAD can be used in place of GET)
+        if method != route.method && !(method == "HEAD" && route.method == "GET") {
+            continue
         }
-        for _, arg := range match[1:] {
-            args = append(args, reflect.ValueOf(arg))
+        if match := route.match(path); match != nil {
+            return route, match
         }
+    }
+    return nil, nil
+}
 
-        ret, err := s.safelyCall(route.handler, args)
-        if err != nil {
-            //there was an error or panic while calling the handler
-            ctx.Abort(500, "Server Error")
-        }
-        if len(ret) == 0 {
+// callHandler invokes a route handler with the captured route parameters
+// and writes its return value to the response.
+func (s *Server) callHandler(ctx *Context, handler reflect.Value, params []string) {
+    var args []reflect.Value
+    handlerType := handler.Type()
+    if requiresContext(handlerType) {
+        //fill ctx.Params; multipart forms are left for the handler to
+        //parse or stream
+        if !isMultipart(ctx.Request) && ctx.ParseForm() == ErrFormTooLarge {
+            ctx.Abort(413, "Request Entity Too Large")
             return
         }
+        args = append(args, reflect.ValueOf(ctx))
+    }
+    for _, arg := range params {
+        args = append(args, reflect.ValueOf(arg))
+    }
 
-        sval := ret[0]
-
-        var content []byte
-
-        if sval.Kind() == reflect.String {
-            content = []byte(sval.String())
-        } else if sval.Kind() == reflect.Slice && sval.Type().Elem().Kind() == reflect.Uint8 {
-            content = sval.Interface().([]byte)
-        }
-        ctx.SetHeader("Content-Length", strconv.Itoa(len(content)), true)
-        _, err = ctx.ResponseWriter.Write(content)
-        if err != nil {
-            ctx.Server.Logger.Println("Error during write: ", err)
-        }
+    ret, err := s.safelyCall(handler, args)
+    if err != nil {
+        //there was an error or panic while calling the handler
+        ctx.Abort(500, "Server Error")
+    }
+    if len(ret) == 0 {
         return
     }
 
-    // try serving index.html or index.htm
-    if req.Method == "GET" || req.Method == "HEAD" {
-        if s.tryServingFile(path.Join(requestPath, "index.html"), req, w) {
-            return
-        } else if s.tryServingFile(path.Join(requestPath, "index.htm"), req, w) {
-            return
-        }
+    sval := ret[0]
+
+    var content []byte
+
+    if sval.Kind() == reflect.String {
+        content = []byte(sval.String())
+    } else if sval.Kind() == reflect.Slice && sval.Type().Elem().Kind() == reflect.Uint8 {
+        content = sval.Interface().([]byte)
+    }
+    ctx.SetHeader("Content-Length", strconv.Itoa(len(content)), true)
+    _, err = ctx.ResponseWriter.Write(content)
+    if err != nil {
+        ctx.Server.Logger.Println("Error during write: ", err)
     }
-    ctx.Abort(404, "Page not found")
 }
 
 // SetLogger sets the logger for server s
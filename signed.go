@@ -0,0 +1,188 @@
+package web
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/base64"
+    "errors"
+    "fmt"
+    "mime"
+    "net/http"
+    "net/url"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "time"
+    "unicode/utf8"
+)
+
+var (
+    errURLSignature = errors.New("invalid URL signature")
+    errURLExpired   = errors.New("URL expired")
+)
+
+// SignURL returns urlPath with a signature that is valid for the duration
+// expiry, for handing out links to files protected by RequireSignedURL or
+// StaticMount.RequireSignature. The signature is an HMAC keyed with
+// Config.CookieSecret.
+func (s *Server) SignURL(urlPath string, expiry time.Duration) string {
+    return s.signURL(urlPath, expiry, "")
+}
+
+// SignURLForIP is like SignURL, but the signature is only valid for
+// requests from clientIP.
+func (s *Server) SignURLForIP(urlPath string, expiry time.Duration, clientIP string) string {
+    return s.signURL(urlPath, expiry, clientIP)
+}
+
+func (s *Server) signURL(urlPath string, expiry time.Duration, clientIP string) string {
+    expires := strconv.FormatInt(time.Now().Add(expiry).Unix(), 10)
+    query := url.Values{}
+    query.Set("expires", expires)
+    if clientIP != "" {
+        query.Set("ip", "1")
+    }
+    query.Set("signature", urlSignature(s.Config.CookieSecret, urlPath, expires, clientIP))
+    u := url.URL{Path: urlPath, RawQuery: query.Encode()}
+    return u.String()
+}
+
+func urlSignature(secret string, urlPath string, expires string, clientIP string) string {
+    mac := hmac.New(sha256.New, []byte(secret))
+    fmt.Fprintf(mac, "url\n%s\n%s\n%s", urlPath, expires, clientIP)
+    return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifySignedURL checks the signature and expiry of the request URL.
+func (ctx *Context) verifySignedURL() error {
+    query := ctx.queryValues()
+    expires := query.Get("expires")
+    var clientIP string
+    if query.Get("ip") != "" {
+        clientIP = ctx.ClientIP()
+    }
+    expected := urlSignature(ctx.Server.Config.CookieSecret, ctx.Request.URL.Path, expires, clientIP)
+    if ctx.Server.Config.CookieSecret == "" || !hmac.Equal([]byte(query.Get("signature")), []byte(expected)) {
+        return errURLSignature
+    }
+    if t, err := strconv.ParseInt(expires, 10, 64); err != nil || time.Now().Unix() > t {
+        return errURLExpired
+    }
+    return nil
+}
+
+// RequireSignedURL returns middleware that only lets requests with a URL
+// signed by Server.SignURL through. Other requests get 403.
+func RequireSignedURL() Middleware {
+    return func(ctx *Context, next func()) {
+        if err := ctx.verifySignedURL(); err != nil {
+            ctx.Abort(403, "Forbidden: "+err.Error())
+            return
+        }
+        next()
+    }
+}
+
+// checkMountSignature verifies the URL signature of a request below a
+// static mount that requires one, so that listings, fallbacks and missing
+// files are protected too. It answers the request with 403 and returns
+// false if the signature is missing or invalid.
+func (s *Server) checkMountSignature(ctx *Context) bool {
+    for _, m := range s.mounts {
+        if _, ok := m.match(ctx.Request.URL.Path); ok {
+            //only the most specific mount applies
+            return s.checkSignature(ctx, m)
+        }
+    }
+    return true
+}
+
+// checkSignature verifies the URL signature of a request for a file of the
+// mount m, if m requires one. m may be nil for files outside of mounts.
+func (s *Server) checkSignature(ctx *Context, m *StaticMount) bool {
+    if m == nil || !m.RequireSignature {
+        return true
+    }
+    if err := ctx.verifySignedURL(); err != nil {
+        ctx.Abort(403, "Forbidden: "+err.Error())
+        return false
+    }
+    return true
+}
+
+// SendFile sends the file at path on disk, supporting range and
+// conditional requests. Its content type is derived from its extension;
+// for unknown extensions, a type set by the handler, e.g. with Attachment,
+// is kept, and application/octet-stream is sent otherwise.
+func (ctx *Context) SendFile(path string) error {
+    f, err := os.Open(path)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    fi, err := f.Stat()
+    if err != nil {
+        return err
+    }
+    if fi.IsDir() {
+        return fmt.Errorf("web: %s is a directory", path)
+    }
+    //replace the default text/html, which http.ServeContent would keep;
+    //files of unknown type are not sniffed, they might be user uploads
+    if ctype := mime.TypeByExtension(filepath.Ext(path)); ctype != "" {
+        ctx.SetHeader("Content-Type", ctype, true)
+    } else if ctx.Header().Get("Content-Type") == defaultContentType {
+        ctx.SetHeader("Content-Type", "application/octet-stream", true)
+    }
+    http.ServeContent(ctx.ResponseWriter, ctx.Request, fi.Name(), fi.ModTime(), f)
+    return nil
+}
+
+// Attachment makes the browser download the response as a file called
+// name instead of displaying it, and sets the content type from the
+// extension of name. Names that are not ASCII are encoded as in RFC 6266.
+func (ctx *Context) Attachment(name string) {
+    name = filepath.Base(name)
+    if ctype := mime.TypeByExtension(filepath.Ext(name)); ctype != "" {
+        ctx.SetHeader("Content-Type", ctype, true)
+    }
+    ctx.SetHeader("Content-Disposition", contentDisposition("attachment", name), true)
+}
+
+// contentDisposition formats a Content-Disposition header with an ASCII
+// fallback filename and, if needed, a UTF-8 filename* parameter.
+func contentDisposition(disposition string, name string) string {
+    var fallback strings.Builder
+    ascii := true
+    for _, r := range name {
+        switch {
+        case r == '"' || r == '\\':
+            fallback.WriteRune('_')
+        case r < 0x20 || r == 0x7f || r >= utf8.RuneSelf:
+            fallback.WriteRune('_')
+            ascii = false
+        default:
+            fallback.WriteRune(r)
+        }
+    }
+    header := disposition + `; filename="` + fallback.String() + `"`
+    if !ascii {
+        header += "; filename*=UTF-8''" + encodeRFC5987(name)
+    }
+    return header
+}
+
+// encodeRFC5987 percent-encodes s except for the attr-chars of RFC 5987.
+func encodeRFC5987(s string) string {
+    var b strings.Builder
+    for i := 0; i < len(s); i++ {
+        c := s[i]
+        if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("!#$&+-.^_`|~", c) >= 0 {
+            b.WriteByte(c)
+        } else {
+            fmt.Fprintf(&b, "%%%02X", c)
+        }
+    }
+    return b.String()
+}
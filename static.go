@@ -0,0 +1,267 @@
+package web
+
+import (
+    "bytes"
+    "encoding/json"
+    "html/template"
+    "io/fs"
+    "net/url"
+    "os"
+    "path"
+    "sort"
+    "strings"
+    "time"
+)
+
+// staticFS returns the filesystems static files are served from, in
+// priority order.
+func (s *Server) staticFS() []fs.FS {
+    var layers []fs.FS
+    layers = append(layers, s.Config.StaticFS...)
+    if s.Config.StaticDir != "" {
+        layers = append(layers, dirFS(s.Config.StaticDir))
+    } else if !s.Config.NoDefaultStaticDirs {
+        for _, staticDir := range defaultStaticDirs {
+            layers = append(layers, dirFS(staticDir))
+        }
+    }
+    return layers
+}
+
+// findStaticFile returns the filesystem and name of the static file at
+// urlPath, and the mount it belongs to, if any. It checks the following filesystems for the file, in order:
+// 1) The directories mounted with Static whose prefix matches urlPath
+// 2) Config.StaticFS
+// 3) Config.StaticDir
+// 4) The 'static' directory in the parent directory of the executable.
+// 5) The 'static' directory in the current working directory
+// The default directories are only checked if Config.StaticDir is empty
+// and Config.NoDefaultStaticDirs is not set. Denied files are never found.
+func (s *Server) findStaticFile(urlPath string) (*StaticMount, fs.FS, string, bool) {
+    for _, m := range s.mounts {
+        if rest, ok := m.match(urlPath); ok && !s.staticDenied(rest) && fileExists(m.fsys, rest) {
+            return m, m.fsys, rest, true
+        }
+    }
+    name := staticPath(urlPath)
+    if s.staticDenied(name) {
+        return nil, nil, "", false
+    }
+    for _, fsys := range s.staticFS() {
+        if fileExists(fsys, name) {
+            return nil, fsys, name, true
+        }
+    }
+    return nil, nil, "", false
+}
+
+// A StaticMount serves a filesystem under a URL prefix. It is created by
+// Static or StaticFS, and its options should be set before the server
+// starts.
+type StaticMount struct {
+    // DirListing enables listings of directories that have no index
+    // file, rendered with ListingTemplate or as JSON if the client accepts
+    // application/json.
+    DirListing      bool
+    ListingTemplate *template.Template
+    // Fallback names a file, such as "index.html", that is served for GET
+    // requests under the prefix that match no file or route, as needed by
+    // single page applications. Paths with a file extension still get a
+    // 404.
+    Fallback string
+    // RequireSignature restricts the mount to URLs signed by
+    // Server.SignURL.
+    RequireSignature bool
+
+    prefix string
+    fsys   fs.FS
+}
+
+// match returns the name in the mounted filesystem of urlPath, if it is
+// below the prefix of the mount.
+func (m *StaticMount) match(urlPath string) (string, bool) {
+    if !strings.HasPrefix(urlPath, m.prefix) {
+        return "", false
+    }
+    rest := urlPath[len(m.prefix):]
+    if rest != "" && rest[0] != '/' && m.prefix != "" {
+        return "", false
+    }
+    return staticPath(rest), true
+}
+
+// Static serves the files in dir under the URL prefix, so that
+// prefix/app.js is dir/app.js. Mounts are checked before the other static
+// directories, longest prefix first.
+func (s *Server) Static(prefix string, dir string) *StaticMount {
+    return s.StaticFS(prefix, dirFS(dir))
+}
+
+// StaticFS serves the files in fsys under the URL prefix.
+func (s *Server) StaticFS(prefix string, fsys fs.FS) *StaticMount {
+    m := &StaticMount{prefix: strings.TrimSuffix(prefix, "/"), fsys: fsys}
+    i := sort.Search(len(s.mounts), func(i int) bool { return len(s.mounts[i].prefix) < len(m.prefix) })
+    s.mounts = append(s.mounts, nil)
+    copy(s.mounts[i+1:], s.mounts[i:])
+    s.mounts[i] = m
+    return m
+}
+
+// serveMountFallback serves a directory listing or the fallback file of
+// the static mount that contains the request path, if it has them.
+func (s *Server) serveMountFallback(ctx *Context) bool {
+    urlPath := ctx.Request.URL.Path
+    for _, m := range s.mounts {
+        name, ok := m.match(urlPath)
+        if !ok {
+            continue
+        } else if s.staticDenied(name) {
+            return false
+        }
+        if m.DirListing {
+            if fi, err := fs.Stat(m.fsys, name); err == nil && fi.IsDir() {
+                if !strings.HasSuffix(urlPath, "/") {
+                    ctx.Redirect(301, urlPath+"/")
+                } else {
+                    m.serveListing(ctx, name)
+                }
+                return true
+            }
+        }
+        if m.Fallback != "" && path.Ext(urlPath) == "" && fileExists(m.fsys, m.Fallback) {
+            if ctx.Header().Get("Cache-Control") == "" {
+                ctx.SetHeader("Cache-Control", "no-cache", true)
+            }
+            s.serveFile(ctx.ResponseWriter, ctx.Request, m.fsys, m.Fallback)
+            return true
+        }
+        //only the most specific mount applies
+        return false
+    }
+    return false
+}
+
+// A DirEntry is an entry of a directory listing.
+type DirEntry struct {
+    Name    string    `json:"name"`
+    URL     string    `json:"url"`
+    IsDir   bool      `json:"dir"`
+    Size    int64     `json:"size"`
+    ModTime time.Time `json:"modified"`
+}
+
+// DefaultListingTemplate renders the HTML directory listings of static
+// mounts. It is executed with the URL path of the directory as .Path and
+// its []DirEntry as .Entries.
+var DefaultListingTemplate = template.Must(template.New("listing").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Index of {{.Path}}</title></head>
+<body>
+<h1>Index of {{.Path}}</h1>
+<ul>
+{{if ne .Path "/"}}<li><a href="../">../</a></li>
+{{end}}{{range .Entries}}<li><a href="{{.URL}}">{{.Name}}{{if .IsDir}}/{{end}}</a></li>
+{{end}}</ul>
+</body>
+</html>
+`))
+
+func (m *StaticMount) serveListing(ctx *Context, name string) {
+    dirents, err := fs.ReadDir(m.fsys, name)
+    if err != nil {
+        ctx.Abort(500, "Server Error")
+        return
+    }
+    entries := []DirEntry{}
+    for _, d := range dirents {
+        fi, err := d.Info()
+        if err != nil || ctx.Server.staticDenied(path.Join(name, d.Name())) {
+            continue
+        }
+        entry := DirEntry{Name: d.Name(), URL: url.PathEscape(d.Name()), IsDir: d.IsDir(), ModTime: fi.ModTime()}
+        if d.IsDir() {
+            entry.URL += "/"
+        } else {
+            entry.Size = fi.Size()
+        }
+        entries = append(entries, entry)
+    }
+
+    if strings.Contains(ctx.Request.Header.Get("Accept"), "application/json") {
+        data, _ := json.Marshal(entries)
+        ctx.SetHeader("Content-Type", "application/json; charset=utf-8", true)
+        ctx.Write(data)
+        return
+    }
+    tmpl := m.ListingTemplate
+    if tmpl == nil {
+        tmpl = DefaultListingTemplate
+    }
+    var buf bytes.Buffer
+    if err := tmpl.Execute(&buf, map[string]interface{}{"Path": ctx.Request.URL.Path, "Entries": entries}); err != nil {
+        ctx.Server.Logger.Printf("Error rendering directory listing: %v\n", err)
+        ctx.Abort(500, "Server Error")
+        return
+    }
+    ctx.SetHeader("Content-Type", "text/html; charset=utf-8", true)
+    ctx.Write(buf.Bytes())
+}
+
+// DefaultStaticDeny lists the glob patterns of static files that are not
+// served if ServerConfig.StaticDeny is nil: editor backups and swap files.
+var DefaultStaticDeny = []string{"*~", "*.bak", "*.orig", "*.swp"}
+
+// staticDenied reports whether the static file name may not be served.
+// Dotfiles other than .well-known are denied unless Config.ServeDotfiles
+// is set, and so are files that match a pattern of Config.StaticDeny,
+// either as a whole or in any path element.
+func (s *Server) staticDenied(name string) bool {
+    if name == "." {
+        return false
+    }
+    patterns := s.Config.StaticDeny
+    if patterns == nil {
+        patterns = DefaultStaticDeny
+    }
+    for _, pattern := range patterns {
+        if ok, _ := path.Match(pattern, name); ok {
+            return true
+        }
+    }
+    for _, elem := range strings.Split(name, "/") {
+        if strings.HasPrefix(elem, ".") && elem != ".well-known" && !s.Config.ServeDotfiles {
+            return true
+        }
+        for _, pattern := range patterns {
+            if ok, _ := path.Match(pattern, elem); ok {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// dirFS is a directory on disk. Unlike os.DirFS, it refuses to follow
+// symlinks that lead out of the directory or are absolute.
+type dirFS string
+
+func (dir dirFS) Open(name string) (fs.File, error) {
+    if !fs.ValidPath(name) {
+        return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+    }
+    root, err := os.OpenRoot(string(dir))
+    if err != nil {
+        return nil, err
+    }
+    defer root.Close()
+    return root.Open(name)
+}
+
+// staticPath converts a URL path to a name in a static filesystem.
+func staticPath(urlPath string) string {
+    name := strings.TrimPrefix(path.Clean("/"+urlPath), "/")
+    if name == "" {
+        return "."
+    }
+    return name
+}
@@ -0,0 +1,191 @@
+package web
+
+import (
+    "crypto/md5"
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "hash"
+    "io"
+    "mime"
+    "mime/multipart"
+    "net/http"
+    "net/textproto"
+    "strings"
+)
+
+var (
+    // ErrPartTooLarge is returned when reading an upload part larger than
+    // UploadReader.MaxPartSize.
+    ErrPartTooLarge = errors.New("web: multipart part too large")
+    // ErrPartType is returned when reading a file whose sniffed content
+    // type is not in UploadReader.AllowedTypes.
+    ErrPartType = errors.New("web: multipart part type not allowed")
+)
+
+// An UploadReader iterates over the parts of a multipart request body
+// without buffering them. Create one with ctx.MultipartReader.
+type UploadReader struct {
+    // MaxPartSize limits the size of every part. Zero means no limit
+    // beyond the body limit of the route.
+    MaxPartSize int64
+    // AllowedTypes lists the content types files may have, such as
+    // "image/png" or "image/*". The type is sniffed from the first bytes of
+    // the file rather than taken from the request. Empty allows any type.
+    AllowedTypes []string
+    // Progress, if set, is called after every read with the number of body
+    // bytes received so far and the length of the body, or -1 if unknown.
+    Progress func(part *UploadPart, received int64, total int64)
+
+    mr    *multipart.Reader
+    body  *countingReader
+    total int64
+}
+
+// An UploadPart is a part of a multipart body. Reading from it streams the
+// part while checking its size and type and computing its checksums.
+type UploadPart struct {
+    FormName string
+    FileName string
+    Header   textproto.MIMEHeader
+    // ContentType is the sniffed content type, known after the first read.
+    ContentType string
+    // Size is the number of bytes read so far.
+    Size int64
+
+    r      *UploadReader
+    part   *multipart.Part
+    buf    []byte
+    md5    hash.Hash
+    sha256 hash.Hash
+    err    error
+}
+
+type countingReader struct {
+    r io.Reader
+    n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+    n, err := c.r.Read(b)
+    c.n += int64(n)
+    return n, err
+}
+
+// MultipartReader returns a reader that streams the parts of a multipart
+// request body. It cannot be used once the form has been parsed, and
+// ctx.Params holds only the query parameters afterwards; CSRF tokens for
+// streamed uploads must be sent in a header.
+func (ctx *Context) MultipartReader() (*UploadReader, error) {
+    req := ctx.Request
+    if ctx.formParsed {
+        return nil, errors.New("web: form already parsed")
+    }
+    ct, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+    if err != nil || (ct != "multipart/form-data" && ct != "multipart/mixed") || params["boundary"] == "" {
+        return nil, http.ErrNotMultipart
+    }
+    ctx.formParsed = true
+    body := &countingReader{r: req.Body}
+    total := req.ContentLength
+    if total <= 0 {
+        total = -1
+    }
+    return &UploadReader{mr: multipart.NewReader(body, params["boundary"]), body: body, total: total}, nil
+}
+
+// NextPart returns the next part of the body, or io.EOF when there are no
+// more parts. The rest of the previous part is skipped.
+func (r *UploadReader) NextPart() (*UploadPart, error) {
+    p, err := r.mr.NextPart()
+    if err != nil {
+        return nil, bodyError(err)
+    }
+    return &UploadPart{
+        FormName: p.FormName(),
+        FileName: p.FileName(),
+        Header:   p.Header,
+        r:        r,
+        part:     p,
+        md5:      md5.New(),
+        sha256:   sha256.New(),
+    }, nil
+}
+
+// bodyError reports an overflow of the body limit as ErrFormTooLarge.
+func bodyError(err error) error {
+    var maxBytesErr *http.MaxBytesError
+    if errors.As(err, &maxBytesErr) {
+        return ErrFormTooLarge
+    }
+    return err
+}
+
+// sniff reads the start of the part to detect its content type and
+// checks it against the allowed types.
+func (p *UploadPart) sniff() error {
+    buf := make([]byte, 512)
+    n, err := io.ReadFull(p.part, buf)
+    if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+        return bodyError(err)
+    }
+    p.buf = buf[:n]
+    p.ContentType = http.DetectContentType(p.buf)
+    if p.FileName == "" || len(p.r.AllowedTypes) == 0 {
+        return nil
+    }
+    ct, _, _ := mime.ParseMediaType(p.ContentType)
+    for _, allowed := range p.r.AllowedTypes {
+        if allowed == ct || (strings.HasSuffix(allowed, "/*") && strings.HasPrefix(ct, allowed[:len(allowed)-1])) {
+            return nil
+        }
+    }
+    return ErrPartType
+}
+
+// Read reads the part's data. It fails with ErrPartTooLarge or ErrPartType
+// if the part violates the limits of its UploadReader.
+func (p *UploadPart) Read(b []byte) (int, error) {
+    if p.err != nil {
+        return 0, p.err
+    }
+    if p.ContentType == "" {
+        if p.err = p.sniff(); p.err != nil {
+            return 0, p.err
+        }
+    }
+
+    var n int
+    var err error
+    if len(p.buf) > 0 {
+        n = copy(b, p.buf)
+        p.buf = p.buf[n:]
+    } else {
+        n, err = p.part.Read(b)
+    }
+    if max := p.r.MaxPartSize; max > 0 && p.Size+int64(n) > max {
+        p.err = ErrPartTooLarge
+        return 0, p.err
+    }
+    p.Size += int64(n)
+    p.md5.Write(b[:n])
+    p.sha256.Write(b[:n])
+    if p.r.Progress != nil && n > 0 {
+        p.r.Progress(p, p.r.body.n, p.r.total)
+    }
+    if err != nil && err != io.EOF {
+        p.err = bodyError(err)
+        return n, p.err
+    }
+    return n, err
+}
+
+// MD5 returns the hex encoded MD5 checksum of the data read so far.
+func (p *UploadPart) MD5() string {
+    return hex.EncodeToString(p.md5.Sum(nil))
+}
+
+// SHA256 returns the hex encoded SHA-256 checksum of the data read so far.
+func (p *UploadPart) SHA256() string {
+    return hex.EncodeToString(p.sha256.Sum(nil))
+}
@@ -0,0 +1,570 @@
+package web
+
+import (
+    "crypto/md5"
+    "crypto/rand"
+    "crypto/sha1"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "hash"
+    "io"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+const tusVersion = "1.0.0"
+
+var (
+    // ErrUploadNotFound is returned by a TusStore for unknown uploads.
+    ErrUploadNotFound = errors.New("web: upload not found")
+    // ErrChecksumMismatch is returned by the reader passed to
+    // TusStore.Append when the data does not match the checksum sent by
+    // the client, or ends before it could be verified.
+    ErrChecksumMismatch = errors.New("web: checksum mismatch")
+)
+
+// A TusUpload describes a resumable upload.
+type TusUpload struct {
+    ID       string
+    Length   int64
+    Offset   int64
+    Metadata map[string]string
+    Expires  time.Time
+    // Completed is set once the upload was handed to OnComplete.
+    Completed bool
+}
+
+// TusStore stores the data of resumable uploads.
+type TusStore interface {
+    // Create creates an empty upload.
+    Create(upload *TusUpload) error
+    // Info returns the upload with the given id, or ErrUploadNotFound.
+    Info(id string) (*TusUpload, error)
+    // Append writes the data read from r at offset, which is the current
+    // offset of the upload, and returns the number of bytes stored. Data
+    // read before r fails is kept so the client can resume, unless r fails
+    // with ErrChecksumMismatch, in which case all of it is discarded.
+    Append(id string, offset int64, r io.Reader) (int64, error)
+    // Open opens the data of an upload for reading.
+    Open(id string) (io.ReadCloser, error)
+    // Complete sets the Completed flag of an upload.
+    Complete(id string) error
+    // Delete removes an upload.
+    Delete(id string) error
+    // List returns the ids of all uploads.
+    List() ([]string, error)
+}
+
+// TusHandler serves resumable uploads using the tus 1.0 protocol with the
+// creation, expiration, checksum and termination extensions. Mount it
+// with Server.Tus or RouteGroup.Tus.
+type TusHandler struct {
+    Store TusStore
+    // MaxSize is the largest upload accepted. Zero means no limit.
+    MaxSize int64
+    // Expiration is how long an upload is kept after its creation,
+    // finished or not. Defaults to 24 hours. Finished uploads should be
+    // moved out of the store by OnComplete, or read from it before they
+    // expire.
+    Expiration time.Duration
+    // OnComplete is called with the data of an upload when it has been
+    // received completely. If it returns an error, the final request
+    // fails with 500, and it is called again when the client retries.
+    // Once it succeeds, it is not called again for the upload.
+    OnComplete func(ctx *Context, upload *TusUpload, file io.Reader) error
+
+    mu        sync.Mutex
+    locks     map[string]bool
+    lastSweep time.Time
+}
+
+// NewTusHandler returns a tus handler that stores uploads in store.
+func NewTusHandler(store TusStore) *TusHandler {
+    return &TusHandler{Store: store}
+}
+
+// Tus mounts tus handler h at prefix. Uploads are created by posting to
+// the prefix and are addressed as prefix/id.
+func (s *Server) Tus(prefix string, h *TusHandler) {
+    s.Group("").Tus(prefix, h)
+}
+
+// Tus mounts tus handler h at prefix in group g.
+func (g *RouteGroup) Tus(prefix string, h *TusHandler) {
+    g.Match("OPTIONS", prefix+"(?:/[0-9a-f]*)?", h.options)
+    g.Post(prefix+"/?", h.create)
+    g.Match("HEAD", prefix+"/([0-9a-f]+)", h.head)
+    g.Match("PATCH", prefix+"/([0-9a-f]+)", h.patch)
+    g.Delete(prefix+"/([0-9a-f]+)", h.terminate)
+}
+
+var tusChecksums = map[string]func() hash.Hash{
+    "md5":    md5.New,
+    "sha1":   sha1.New,
+    "sha256": sha256.New,
+}
+
+func (h *TusHandler) options(ctx *Context) {
+    algorithms := make([]string, 0, len(tusChecksums))
+    for alg := range tusChecksums {
+        algorithms = append(algorithms, alg)
+    }
+    sort.Strings(algorithms)
+    ctx.SetHeader("Tus-Resumable", tusVersion, true)
+    ctx.SetHeader("Tus-Version", tusVersion, true)
+    ctx.SetHeader("Tus-Extension", "creation,expiration,checksum,termination", true)
+    ctx.SetHeader("Tus-Checksum-Algorithm", strings.Join(algorithms, ","), true)
+    if h.MaxSize > 0 {
+        ctx.SetHeader("Tus-Max-Size", strconv.FormatInt(h.MaxSize, 10), true)
+    }
+    ctx.WriteHeader(204)
+}
+
+// begin checks the protocol version of a request. It answers the request
+// and returns false if the version is not supported.
+func (h *TusHandler) begin(ctx *Context) bool {
+    ctx.SetHeader("Tus-Resumable", tusVersion, true)
+    ctx.SetHeader("Cache-Control", "no-store", true)
+    if ctx.Request.Header.Get("Tus-Resumable") != tusVersion {
+        ctx.SetHeader("Tus-Version", tusVersion, true)
+        ctx.Abort(412, "Unsupported tus version")
+        return false
+    }
+    return true
+}
+
+func (h *TusHandler) expiration() time.Duration {
+    if h.Expiration > 0 {
+        return h.Expiration
+    }
+    return 24 * time.Hour
+}
+
+// info returns the unexpired upload with the given id. It answers the
+// request and returns nil if there is none.
+func (h *TusHandler) info(ctx *Context, id string) *TusUpload {
+    upload, err := h.Store.Info(id)
+    if err == ErrUploadNotFound {
+        ctx.NotFound("Upload not found")
+        return nil
+    } else if err != nil {
+        ctx.Server.Logger.Printf("tus: %v\n", err)
+        ctx.Abort(500, "Server Error")
+        return nil
+    }
+    if time.Now().After(upload.Expires) {
+        h.Store.Delete(id)
+        ctx.Abort(410, "Upload expired")
+        return nil
+    }
+    return upload
+}
+
+// sweep deletes expired uploads in the background, at most once a minute.
+func (h *TusHandler) sweep() {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    if time.Since(h.lastSweep) < time.Minute {
+        return
+    }
+    h.lastSweep = time.Now()
+    go h.deleteExpired()
+}
+
+func (h *TusHandler) deleteExpired() {
+    ids, _ := h.Store.List()
+    for _, id := range ids {
+        if upload, err := h.Store.Info(id); err == nil && time.Now().After(upload.Expires) {
+            h.Store.Delete(id)
+        }
+    }
+}
+
+func (h *TusHandler) create(ctx *Context) {
+    if !h.begin(ctx) {
+        return
+    }
+    h.sweep()
+
+    length, err := strconv.ParseInt(ctx.Request.Header.Get("Upload-Length"), 10, 64)
+    if err != nil || length < 0 {
+        ctx.Abort(400, "Invalid Upload-Length")
+        return
+    }
+    if h.MaxSize > 0 && length > h.MaxSize {
+        ctx.Abort(413, "Upload too large")
+        return
+    }
+    metadata, err := parseTusMetadata(ctx.Request.Header.Get("Upload-Metadata"))
+    if err != nil {
+        ctx.Abort(400, "Invalid Upload-Metadata")
+        return
+    }
+
+    id := make([]byte, 16)
+    if _, err := rand.Read(id); err != nil {
+        ctx.Abort(500, "Server Error")
+        return
+    }
+    upload := &TusUpload{
+        ID:       hex.EncodeToString(id),
+        Length:   length,
+        Metadata: metadata,
+        Expires:  time.Now().Add(h.expiration()).UTC(),
+    }
+    if err := h.Store.Create(upload); err != nil {
+        ctx.Server.Logger.Printf("tus: %v\n", err)
+        ctx.Abort(500, "Server Error")
+        return
+    }
+    ctx.SetHeader("Location", strings.TrimSuffix(ctx.Request.URL.Path, "/")+"/"+upload.ID, true)
+    if length == 0 {
+        //an empty upload is complete as soon as it exists
+        if !h.complete(ctx, upload) {
+            return
+        }
+    } else {
+        ctx.SetHeader("Upload-Expires", webTime(upload.Expires), true)
+    }
+    ctx.WriteHeader(201)
+}
+
+func (h *TusHandler) head(ctx *Context, id string) {
+    if !h.begin(ctx) {
+        return
+    }
+    upload := h.info(ctx, id)
+    if upload == nil {
+        return
+    }
+    ctx.SetHeader("Upload-Offset", strconv.FormatInt(upload.Offset, 10), true)
+    ctx.SetHeader("Upload-Length", strconv.FormatInt(upload.Length, 10), true)
+    if len(upload.Metadata) > 0 {
+        ctx.SetHeader("Upload-Metadata", formatTusMetadata(upload.Metadata), true)
+    }
+    if upload.Offset < upload.Length {
+        ctx.SetHeader("Upload-Expires", webTime(upload.Expires), true)
+    }
+    ctx.WriteHeader(200)
+}
+
+func (h *TusHandler) patch(ctx *Context, id string) {
+    if !h.begin(ctx) {
+        return
+    }
+    req := ctx.Request
+    if req.Header.Get("Content-Type") != "application/offset+octet-stream" {
+        ctx.Abort(415, "Content-Type must be application/offset+octet-stream")
+        return
+    }
+    offset, err := strconv.ParseInt(req.Header.Get("Upload-Offset"), 10, 64)
+    if err != nil || offset < 0 {
+        ctx.Abort(400, "Invalid Upload-Offset")
+        return
+    }
+    var newHash func() hash.Hash
+    var expected []byte
+    if checksum := req.Header.Get("Upload-Checksum"); checksum != "" {
+        alg, sum, _ := strings.Cut(checksum, " ")
+        newHash = tusChecksums[alg]
+        expected, err = base64.StdEncoding.DecodeString(sum)
+        if newHash == nil || err != nil {
+            ctx.Abort(400, "Invalid Upload-Checksum")
+            return
+        }
+    }
+
+    //a client that lost its connection may resume before the server
+    //notices, so concurrent requests for an upload are refused
+    h.mu.Lock()
+    if h.locks == nil {
+        h.locks = map[string]bool{}
+    }
+    if h.locks[id] {
+        h.mu.Unlock()
+        ctx.Abort(423, "Upload locked")
+        return
+    }
+    h.locks[id] = true
+    h.mu.Unlock()
+    defer func() {
+        h.mu.Lock()
+        delete(h.locks, id)
+        h.mu.Unlock()
+    }()
+
+    upload := h.info(ctx, id)
+    if upload == nil {
+        return
+    }
+    if offset != upload.Offset {
+        ctx.Abort(409, "Upload-Offset does not match")
+        return
+    }
+    if upload.Offset == upload.Length {
+        //a retry of the final request; the upload may not have been
+        //handed off if OnComplete failed
+        ctx.SetHeader("Upload-Offset", strconv.FormatInt(upload.Offset, 10), true)
+        if upload.Completed || h.complete(ctx, upload) {
+            ctx.WriteHeader(204)
+        }
+        return
+    }
+    remaining := upload.Length - offset
+    if req.ContentLength > remaining {
+        ctx.Abort(413, "Upload exceeds Upload-Length")
+        return
+    }
+    var body io.Reader = io.LimitReader(req.Body, remaining)
+    var checksum *checksumReader
+    if newHash != nil {
+        checksum = &checksumReader{r: body, h: newHash(), expected: expected}
+        body = checksum
+    }
+    n, err := h.Store.Append(id, offset, body)
+    upload.Offset += n
+    if err == ErrChecksumMismatch && checksum != nil && checksum.err != nil {
+        //the data was discarded unverified
+        err = checksum.err
+    }
+    if err == ErrChecksumMismatch {
+        ctx.Abort(460, "Checksum Mismatch")
+        return
+    } else if err != nil {
+        //the client resumes from the stored offset
+        ctx.Server.Logger.Printf("tus: %v\n", err)
+        ctx.SetHeader("Upload-Offset", strconv.FormatInt(upload.Offset, 10), true)
+        ctx.Abort(500, "Server Error")
+        return
+    }
+    ctx.SetHeader("Upload-Offset", strconv.FormatInt(upload.Offset, 10), true)
+    if upload.Offset < upload.Length {
+        ctx.SetHeader("Upload-Expires", webTime(upload.Expires), true)
+    } else if !h.complete(ctx, upload) {
+        return
+    }
+    ctx.WriteHeader(204)
+}
+
+// complete calls OnComplete for a finished upload and marks the upload as
+// completed. It answers the request and returns false if either fails.
+func (h *TusHandler) complete(ctx *Context, upload *TusUpload) bool {
+    var err error
+    if h.OnComplete != nil {
+        var file io.ReadCloser
+        file, err = h.Store.Open(upload.ID)
+        if err == nil {
+            err = h.OnComplete(ctx, upload, file)
+            file.Close()
+        }
+    }
+    if err == nil {
+        err = h.Store.Complete(upload.ID)
+    }
+    if err != nil {
+        ctx.Server.Logger.Printf("tus: completing upload %s: %v\n", upload.ID, err)
+        ctx.Abort(500, "Server Error")
+        return false
+    }
+    return true
+}
+
+func (h *TusHandler) terminate(ctx *Context, id string) {
+    if !h.begin(ctx) {
+        return
+    }
+    if err := h.Store.Delete(id); err == ErrUploadNotFound {
+        ctx.NotFound("Upload not found")
+        return
+    } else if err != nil {
+        ctx.Server.Logger.Printf("tus: %v\n", err)
+        ctx.Abort(500, "Server Error")
+        return
+    }
+    ctx.WriteHeader(204)
+}
+
+// checksumReader fails with ErrChecksumMismatch at the end of the data if
+// its checksum does not match. Since unverified data must not be stored,
+// it also fails with ErrChecksumMismatch if reading the data fails, and
+// keeps the error in err.
+type checksumReader struct {
+    r        io.Reader
+    h        hash.Hash
+    expected []byte
+    err      error
+}
+
+func (c *checksumReader) Read(b []byte) (int, error) {
+    n, err := c.r.Read(b)
+    c.h.Write(b[:n])
+    if err == io.EOF && string(c.h.Sum(nil)) != string(c.expected) {
+        return n, ErrChecksumMismatch
+    } else if err != nil && err != io.EOF {
+        c.err = err
+        return n, ErrChecksumMismatch
+    }
+    return n, err
+}
+
+// parseTusMetadata parses an Upload-Metadata header: comma separated keys,
+// each followed by a space and its base64 encoded value.
+func parseTusMetadata(header string) (map[string]string, error) {
+    metadata := map[string]string{}
+    for _, pair := range strings.Split(header, ",") {
+        pair = strings.TrimSpace(pair)
+        if pair == "" {
+            continue
+        }
+        key, value, _ := strings.Cut(pair, " ")
+        decoded, err := base64.StdEncoding.DecodeString(value)
+        if err != nil {
+            return nil, err
+        }
+        metadata[key] = string(decoded)
+    }
+    return metadata, nil
+}
+
+func formatTusMetadata(metadata map[string]string) string {
+    var pairs []string
+    for k, v := range metadata {
+        pairs = append(pairs, k+" "+base64.StdEncoding.EncodeToString([]byte(v)))
+    }
+    sort.Strings(pairs)
+    return strings.Join(pairs, ",")
+}
+
+// TusDiskStore is a TusStore that keeps every upload in a data file and an
+// info file in a directory.
+type TusDiskStore struct {
+    Dir string
+}
+
+// NewTusDiskStore returns a store that keeps uploads in dir, creating it
+// if needed.
+func NewTusDiskStore(dir string) (*TusDiskStore, error) {
+    if err := os.MkdirAll(dir, 0700); err != nil {
+        return nil, err
+    }
+    return &TusDiskStore{Dir: dir}, nil
+}
+
+func (d *TusDiskStore) path(id string) string {
+    return filepath.Join(d.Dir, filepath.Base(id))
+}
+
+// Create creates the data and info files of an upload.
+func (d *TusDiskStore) Create(upload *TusUpload) error {
+    info, err := json.Marshal(upload)
+    if err != nil {
+        return err
+    }
+    f, err := os.OpenFile(d.path(upload.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+    if err != nil {
+        return err
+    }
+    f.Close()
+    return ioutil.WriteFile(d.path(upload.ID)+".info", info, 0600)
+}
+
+// Info reads the info file of an upload. The offset is the size of its
+// data file.
+func (d *TusDiskStore) Info(id string) (*TusUpload, error) {
+    data, err := ioutil.ReadFile(d.path(id) + ".info")
+    if os.IsNotExist(err) {
+        return nil, ErrUploadNotFound
+    } else if err != nil {
+        return nil, err
+    }
+    var upload TusUpload
+    if err := json.Unmarshal(data, &upload); err != nil {
+        return nil, err
+    }
+    fi, err := os.Stat(d.path(id))
+    if err != nil {
+        return nil, err
+    }
+    upload.Offset = fi.Size()
+    return &upload, nil
+}
+
+// Complete rewrites the info file of an upload with the Completed flag set.
+func (d *TusDiskStore) Complete(id string) error {
+    upload, err := d.Info(id)
+    if err != nil {
+        return err
+    }
+    upload.Completed = true
+    info, err := json.Marshal(upload)
+    if err != nil {
+        return err
+    }
+    //replace the info file atomically
+    tmp := d.path(id) + ".info.tmp"
+    if err := ioutil.WriteFile(tmp, info, 0600); err != nil {
+        return err
+    }
+    return os.Rename(tmp, d.path(id)+".info")
+}
+
+// Append appends data to the data file of an upload.
+func (d *TusDiskStore) Append(id string, offset int64, r io.Reader) (int64, error) {
+    f, err := os.OpenFile(d.path(id), os.O_WRONLY, 0600)
+    if os.IsNotExist(err) {
+        return 0, ErrUploadNotFound
+    } else if err != nil {
+        return 0, err
+    }
+    defer f.Close()
+    if _, err := f.Seek(offset, io.SeekStart); err != nil {
+        return 0, err
+    }
+    n, err := io.Copy(f, r)
+    if err == ErrChecksumMismatch {
+        f.Truncate(offset)
+        return 0, err
+    }
+    return n, err
+}
+
+// Open opens the data file of an upload.
+func (d *TusDiskStore) Open(id string) (io.ReadCloser, error) {
+    f, err := os.Open(d.path(id))
+    if os.IsNotExist(err) {
+        return nil, ErrUploadNotFound
+    }
+    return f, err
+}
+
+// Delete removes the files of an upload.
+func (d *TusDiskStore) Delete(id string) error {
+    err := os.Remove(d.path(id) + ".info")
+    if os.IsNotExist(err) {
+        return ErrUploadNotFound
+    }
+    os.Remove(d.path(id))
+    return err
+}
+
+// List returns the ids of the uploads in the directory.
+func (d *TusDiskStore) List() ([]string, error) {
+    matches, err := filepath.Glob(filepath.Join(d.Dir, "*.info"))
+    if err != nil {
+        return nil, err
+    }
+    var ids []string
+    for _, m := range matches {
+        ids = append(ids, strings.TrimSuffix(filepath.Base(m), ".info"))
+    }
+    return ids, nil
+}
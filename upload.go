@@ -0,0 +1,194 @@
+package web
+
+import (
+    "errors"
+    "io"
+    "mime/multipart"
+    "net/http"
+    "net/textproto"
+    "net/url"
+)
+
+const (
+    defaultMultipartMemory = 32 << 20
+    defaultMaxFormFields   = 1000
+    defaultMaxFormFiles    = 100
+)
+
+// ErrFormTooLarge is returned by ParseForm when the request body or the
+// form it contains exceeds one of the limits of ServerConfig.
+var ErrFormTooLarge = errors.New("web: form too large")
+
+// An UploadedFile is a file received in a multipart form. Small files are
+// held in memory, larger ones in a temporary file that is removed once
+// the handler returns. It is also available from ctx.Request.FormFile.
+type UploadedFile struct {
+    Filename string
+    Header   textproto.MIMEHeader
+    Size     int64
+
+    fh *multipart.FileHeader
+}
+
+// Open opens the uploaded file for reading.
+func (f *UploadedFile) Open() (multipart.File, error) {
+    return f.fh.Open()
+}
+
+// FormFile returns the first file uploaded under the form field name, or
+// nil if there is none. It parses the form on first use.
+func (ctx *Context) FormFile(name string) *UploadedFile {
+    ctx.ParseForm()
+    if files := ctx.files[name]; len(files) > 0 {
+        return files[0]
+    }
+    return nil
+}
+
+// FormFiles returns the files uploaded under the form field name.
+func (ctx *Context) FormFiles(name string) []*UploadedFile {
+    ctx.ParseForm()
+    return ctx.files[name]
+}
+
+// BodyLimit returns a group whose routes accept request bodies of at most
+// n bytes, overriding ServerConfig.MaxBodySize.
+func (s *Server) BodyLimit(n int64) *RouteGroup {
+    return &RouteGroup{s: s, maxBody: n}
+}
+
+// BodyLimit returns a copy of group g whose routes accept request bodies
+// of at most n bytes.
+func (g *RouteGroup) BodyLimit(n int64) *RouteGroup {
+    ng := g.Group("")
+    ng.maxBody = n
+    return ng
+}
+
+// limitBody limits the size of the request body to the limit of its
+// route or ServerConfig.MaxBodySize. It answers the request itself and
+// returns false if the declared length of the body is already too large.
+func (s *Server) limitBody(ctx *Context) bool {
+    req := ctx.Request
+    limit := s.Config.MaxBodySize
+    if route, _ := s.findRoute(req.Method, req.URL.Path); route != nil && route.maxBody > 0 {
+        limit = route.maxBody
+    }
+    if limit > 0 {
+        if req.ContentLength > limit {
+            ctx.Abort(413, "Request Entity Too Large")
+            return false
+        }
+        req.Body = http.MaxBytesReader(ctx.ResponseWriter, req.Body, limit)
+    }
+    return true
+}
+
+// parseMultipart reads a multipart form, holding at most
+// Config.MultipartMemory bytes in memory and writing the remainder of
+// uploaded files to temporary files. The form is stored by
+// multipart.Reader.ReadForm, so that req.MultipartForm and req.FormFile
+// work as with http.Request.ParseMultipartForm; the parts are checked
+// against the limits of Config on their way to it.
+func (s *Server) parseMultipart(ctx *Context) error {
+    req := ctx.Request
+    mr, err := req.MultipartReader()
+    if err != nil {
+        return err
+    }
+    memory := s.Config.MultipartMemory
+    if memory <= 0 {
+        memory = defaultMultipartMemory
+    }
+
+    pr, pw := io.Pipe()
+    mw := multipart.NewWriter(pw)
+    done := make(chan struct{})
+    go func() {
+        pw.CloseWithError(s.copyParts(mw, mr, memory))
+        close(done)
+    }()
+    form, err := multipart.NewReader(pr, mw.Boundary()).ReadForm(memory)
+    //stop the copy if ReadForm failed, and don't return before it stopped
+    //reading the body
+    pr.CloseWithError(errors.New("web: form not read"))
+    <-done
+    if errors.Is(err, ErrFormTooLarge) || errors.Is(err, multipart.ErrMessageTooLarge) {
+        return ErrFormTooLarge
+    } else if err != nil {
+        return err
+    }
+
+    ctx.form = form
+    ctx.files = map[string][]*UploadedFile{}
+    for name, headers := range form.File {
+        for _, fh := range headers {
+            ctx.files[name] = append(ctx.files[name], &UploadedFile{Filename: fh.Filename, Header: fh.Header, Size: fh.Size, fh: fh})
+        }
+    }
+    req.MultipartForm = form
+    if req.PostForm == nil {
+        req.PostForm = url.Values{}
+    }
+    for k, v := range form.Value {
+        req.Form[k] = append(append([]string{}, v...), req.Form[k]...)
+        req.PostForm[k] = append(req.PostForm[k], v...)
+    }
+    return nil
+}
+
+// copyParts copies the named parts of mr to mw, failing with
+// ErrFormTooLarge once there are too many fields or files, or the fields
+// take more than memory bytes.
+func (s *Server) copyParts(mw *multipart.Writer, mr *multipart.Reader, memory int64) error {
+    maxFields := s.Config.MaxFormFields
+    if maxFields <= 0 {
+        maxFields = defaultMaxFormFields
+    }
+    maxFiles := s.Config.MaxFormFiles
+    if maxFiles <= 0 {
+        maxFiles = defaultMaxFormFiles
+    }
+    fields, files := 0, 0
+    for {
+        part, err := mr.NextPart()
+        if err == io.EOF {
+            return mw.Close()
+        } else if err != nil {
+            return err
+        }
+        if part.FormName() == "" {
+            part.Close()
+            continue
+        }
+        var r io.Reader = part
+        if part.FileName() == "" {
+            if fields++; fields > maxFields {
+                return ErrFormTooLarge
+            }
+            r = io.LimitReader(part, memory+1)
+        } else if files++; files > maxFiles {
+            return ErrFormTooLarge
+        }
+        w, err := mw.CreatePart(part.Header)
+        if err != nil {
+            return err
+        }
+        n, err := io.Copy(w, r)
+        if err != nil {
+            return err
+        }
+        if part.FileName() == "" {
+            if memory -= n; memory < 0 {
+                return ErrFormTooLarge
+            }
+        }
+    }
+}
+
+// removeUploads deletes the temporary files of the request's uploads.
+func (ctx *Context) removeUploads() {
+    if ctx.form != nil {
+        ctx.form.RemoveAll()
+    }
+}
@@ -7,12 +7,16 @@ import (
     "crypto/hmac"
     "crypto/sha1"
     "crypto/tls"
+    "crypto/x509"
     "encoding/base64"
     "fmt"
+    "io/fs"
     "io/ioutil"
     "log"
     "mime"
+    "mime/multipart"
     "net/http"
+    "net/url"
     "os"
     "path"
     "reflect"
@@ -30,6 +34,22 @@ type Context struct {
     Params  map[string]string
     Server  *Server
     http.ResponseWriter
+
+    csrf      *csrfState
+    cspNonce  string
+    user      string
+    claims    Claims
+    principal *Principal
+
+    clientCert     *x509.Certificate
+    clientCertDone bool
+    forwarded      *forwardedHop
+
+    query      url.Values
+    formParsed bool
+    formErr    error
+    form       *multipart.Form
+    files      map[string][]*UploadedFile
 }
 
 // WriteString writes string data into the response object.
@@ -110,12 +130,10 @@ func getCookieSig(key string, val []byte, timestamp string) string {
     return hex
 }
 
-func (ctx *Context) SetSecureCookie(name string, val string, age int64) {
+// encodeSecureCookie returns the signed, timestamped form of val that is
+// stored in a secure cookie.
+func encodeSecureCookie(secret string, val string) string {
     //base64 encode the val
-    if len(ctx.Server.Config.CookieSecret) == 0 {
-        ctx.Server.Logger.Println("Secret Key for secure cookies has not been set. Please assign a cookie secret to web.Config.CookieSecret.")
-        return
-    }
     var buf bytes.Buffer
     encoder := base64.NewEncoder(base64.StdEncoding, &buf)
     encoder.Write([]byte(val))
@@ -123,38 +141,54 @@ func (ctx *Context) SetSecureCookie(name string, val string, age int64) {
     vs := buf.String()
     vb := buf.Bytes()
     timestamp := strconv.FormatInt(time.Now().Unix(), 10)
-    sig := getCookieSig(ctx.Server.Config.CookieSecret, vb, timestamp)
-    cookie := strings.Join([]string{vs, timestamp, sig}, "|")
-    ctx.SetCookie(NewCookie(name, cookie, age))
+    sig := getCookieSig(secret, vb, timestamp)
+    return strings.Join([]string{vs, timestamp, sig}, "|")
 }
 
-func (ctx *Context) GetSecureCookie(name string) (string, bool) {
-    for _, cookie := range ctx.Request.Cookies() {
-        if cookie.Name != name {
-            continue
-        }
+// decodeSecureCookie verifies a value produced by encodeSecureCookie and
+// returns the original value.
+func decodeSecureCookie(secret string, value string) (string, bool) {
+    parts := strings.SplitN(value, "|", 3)
+    if len(parts) != 3 {
+        return "", false
+    }
 
-        parts := strings.SplitN(cookie.Value, "|", 3)
+    val := parts[0]
+    timestamp := parts[1]
+    sig := parts[2]
 
-        val := parts[0]
-        timestamp := parts[1]
-        sig := parts[2]
+    if getCookieSig(secret, []byte(val), timestamp) != sig {
+        return "", false
+    }
 
-        if getCookieSig(ctx.Server.Config.CookieSecret, []byte(val), timestamp) != sig {
-            return "", false
-        }
+    ts, _ := strconv.ParseInt(timestamp, 0, 64)
 
-        ts, _ := strconv.ParseInt(timestamp, 0, 64)
+    if time.Now().Unix()-31*86400 > ts {
+        return "", false
+    }
 
-        if time.Now().Unix()-31*86400 > ts {
-            return "", false
-        }
+    buf := bytes.NewBufferString(val)
+    encoder := base64.NewDecoder(base64.StdEncoding, buf)
 
-        buf := bytes.NewBufferString(val)
-        encoder := base64.NewDecoder(base64.StdEncoding, buf)
+    res, _ := ioutil.ReadAll(encoder)
+    return string(res), true
+}
 
-        res, _ := ioutil.ReadAll(encoder)
-        return string(res), true
+func (ctx *Context) SetSecureCookie(name string, val string, age int64) {
+    if len(ctx.Server.Config.CookieSecret) == 0 {
+        ctx.Server.Logger.Println("Secret Key for secure cookies has not been set. Please assign a cookie secret to web.Config.CookieSecret.")
+        return
+    }
+    cookie := encodeSecureCookie(ctx.Server.Config.CookieSecret, val)
+    ctx.SetCookie(NewCookie(name, cookie, age))
+}
+
+func (ctx *Context) GetSecureCookie(name string) (string, bool) {
+    for _, cookie := range ctx.Request.Cookies() {
+        if cookie.Name != name {
+            continue
+        }
+        return decodeSecureCookie(ctx.Server.Config.CookieSecret, cookie.Value)
     }
     return "", false
 }
@@ -237,6 +271,67 @@ func Match(method string, route string, handler interface{}) {
     mainServer.addRoute(route, method, handler)
 }
 
+// Use adds middleware that runs for every request to the main server.
+func Use(middleware ...Middleware) {
+    mainServer.Use(middleware...)
+}
+
+// Group returns a route group for the main server.
+func Group(prefix string, middleware ...Middleware) *RouteGroup {
+    return mainServer.Group(prefix, middleware...)
+}
+
+// Require returns a group of routes of the main server that may only be
+// invoked by principals that satisfy access.
+func Require(access Access) *RouteGroup {
+    return mainServer.Require(access)
+}
+
+// BodyLimit returns a group of the main server whose routes accept request
+// bodies of at most n bytes.
+func BodyLimit(n int64) *RouteGroup {
+    return mainServer.BodyLimit(n)
+}
+
+// Static serves the files in dir under the URL prefix on the main server.
+func Static(prefix string, dir string) *StaticMount {
+    return mainServer.Static(prefix, dir)
+}
+
+// StaticFS serves the files in fsys under the URL prefix on the main server.
+func StaticFS(prefix string, fsys fs.FS) *StaticMount {
+    return mainServer.StaticFS(prefix, fsys)
+}
+
+// CacheControl sets the Cache-Control header of the main server's static
+// files that match.
+func CacheControl(match string, cacheControl string) {
+    mainServer.CacheControl(match, cacheControl)
+}
+
+// Fingerprint computes the content hashes of the main server's static
+// files.
+func Fingerprint() error {
+    return mainServer.Fingerprint()
+}
+
+// AssetURL returns the fingerprinted URL of the main server's static file
+// at urlPath.
+func AssetURL(urlPath string) string {
+    return mainServer.AssetURL(urlPath)
+}
+
+// SignURL returns urlPath with a signature of the main server that is
+// valid for the duration expiry.
+func SignURL(urlPath string, expiry time.Duration) string {
+    return mainServer.SignURL(urlPath, expiry)
+}
+
+// Tus mounts tus handler h at prefix on the main server.
+func Tus(prefix string, h *TusHandler) {
+    mainServer.Tus(prefix, h)
+}
+
 // SetLogger sets the logger for the main server.
 func SetLogger(logger *log.Logger) {
     mainServer.Logger = logger
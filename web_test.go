@@ -1,19 +1,51 @@
 package web
 
 import (
+    "bufio"
     "bytes"
+    "compress/gzip"
+    "crypto/ecdsa"
+    "crypto/ed25519"
+    "crypto/elliptic"
+    "crypto/md5"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha1"
+    "crypto/sha256"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/asn1"
+    "encoding/base64"
+    "encoding/binary"
+    "encoding/hex"
     "encoding/json"
+    "encoding/pem"
     "errors"
     "fmt"
+    "hash"
+    "hash/crc32"
+    "html/template"
     "io"
+    "io/fs"
     "io/ioutil"
     "log"
+    "math/big"
+    "mime/multipart"
+    "net"
     "net/http"
+    "net/http/httptest"
     "net/url"
+    "os"
+    "path/filepath"
     "runtime"
     "strconv"
     "strings"
+    "sync"
     "testing"
+    "testing/fstest"
+    "testing/iotest"
+    "time"
 )
 
 func init() {
@@ -99,15 +131,28 @@ func buildTestResponse(buf *bytes.Buffer) *testResponse {
 }
 
 func getTestResponse(method string, path string, body string, headers map[string][]string, cookies []*http.Cookie) *testResponse {
+    return getServerTestResponse(mainServer, method, path, body, headers, cookies)
+}
+
+func getServerTestResponse(s *Server, method string, path string, body string, headers map[string][]string, cookies []*http.Cookie) *testResponse {
     req := buildTestRequest(method, path, body, headers, cookies)
     var buf bytes.Buffer
 
     tcpb := ioBuffer{input: nil, output: &buf}
     c := scgiConn{wroteHeaders: false, req: req, headers: make(map[string][]string), fd: &tcpb}
-    mainServer.Process(&c, req)
+    s.Process(&c, req)
     return buildTestResponse(&buf)
 }
 
+// newTestServer returns a server with its own configuration and a
+// discarding logger, for tests that install middleware.
+func newTestServer() *Server {
+    s := NewServer()
+    s.Config = &ServerConfig{CookieSecret: "7C19QRmwf3mHZ9CPAaPQ0hsWeufKd"}
+    s.SetLogger(log.New(ioutil.Discard, "", 0))
+    return s
+}
+
 func testGet(path string, headers map[string]string) *testResponse {
     var header http.Header
     for k, v := range headers {
@@ -519,3 +564,2031 @@ func TestDuplicateHeader(t *testing.T) {
         t.Fatalf("Incorrect header, exp 'myserver', got %q", resp.headers["Server"][0])
     }
 }
+
+func TestCSRF(t *testing.T) {
+    s := newTestServer()
+    s.Use(CSRF(&CSRFConfig{Exempt: []string{"/hook/.*"}}))
+    s.Get("/form", func(ctx *Context) string { return ctx.CSRFToken() })
+    s.Post("/say", func(ctx *Context) string { return "said " + ctx.Params["said"] })
+    s.Post("/hook/(.*)", func(name string) string { return name })
+
+    form := map[string][]string{"Content-Type": {"application/x-www-form-urlencoded"}}
+    resp := getServerTestResponse(s, "POST", "/say", "said=hi", form, nil)
+    if resp.statusCode != 403 {
+        t.Fatalf("expected 403 without token, got %d", resp.statusCode)
+    }
+
+    resp = getServerTestResponse(s, "GET", "/form", "", nil, nil)
+    token := resp.body
+    cookies := makeCookie(map[string]string{"_csrf": resp.cookies["_csrf"]})
+    if token == "" || len(cookies) != 1 {
+        t.Fatalf("expected a CSRF token and cookie")
+    }
+
+    resp = getServerTestResponse(s, "POST", "/say", "said=hi&_csrf=wrong", form, cookies)
+    if resp.statusCode != 403 {
+        t.Fatalf("expected 403 with wrong token, got %d", resp.statusCode)
+    }
+    resp = getServerTestResponse(s, "POST", "/say", "said=hi&_csrf="+url.QueryEscape(token), form, cookies)
+    if resp.statusCode != 200 || resp.body != "said hi" {
+        t.Fatalf("expected form token to be accepted, got %d %q", resp.statusCode, resp.body)
+    }
+    headers := map[string][]string{"X-Csrf-Token": {token}}
+    resp = getServerTestResponse(s, "POST", "/say", "", headers, cookies)
+    if resp.statusCode != 200 {
+        t.Fatalf("expected header token to be accepted, got %d", resp.statusCode)
+    }
+    resp = getServerTestResponse(s, "POST", "/hook/a", "", nil, nil)
+    if resp.statusCode != 200 || resp.body != "a" {
+        t.Fatalf("expected exempt route to be allowed, got %d", resp.statusCode)
+    }
+}
+
+func TestRouteGroup(t *testing.T) {
+    s := newTestServer()
+    var calls []string
+    s.Use(func(ctx *Context, next func()) {
+        calls = append(calls, "server")
+        next()
+    })
+    admin := s.Group("/admin", func(ctx *Context, next func()) {
+        calls = append(calls, "group")
+        if ctx.Params["key"] != "secret" {
+            ctx.Abort(401, "Unauthorized")
+            return
+        }
+        next()
+    })
+    admin.Get("/(.*)", func(name string) string { return name })
+
+    resp := getServerTestResponse(s, "GET", "/admin/users", "", nil, nil)
+    if resp.statusCode != 401 {
+        t.Fatalf("expected 401, got %d", resp.statusCode)
+    }
+    resp = getServerTestResponse(s, "GET", "/admin/users?key=secret", "", nil, nil)
+    if resp.statusCode != 200 || resp.body != "users" {
+        t.Fatalf("expected group route to run, got %d %q", resp.statusCode, resp.body)
+    }
+    if strings.Join(calls, ",") != "server,group,server,group" {
+        t.Fatalf("unexpected middleware order %v", calls)
+    }
+}
+
+func TestCORS(t *testing.T) {
+    s := newTestServer()
+    s.Use(CORS(&CORSConfig{
+        AllowedOrigins:   []string{"https://example.com", "https://*.example.org"},
+        AllowedHeaders:   []string{"Content-Type", "X-Token"},
+        ExposedHeaders:   []string{"X-Total"},
+        AllowCredentials: true,
+        MaxAge:           600,
+    }))
+    s.Get("/items", func() string { return "items" })
+    s.Post("/items", func() string { return "created" })
+
+    preflight := func(origin, method, headers string) *testResponse {
+        h := map[string][]string{"Origin": {origin}, "Access-Control-Request-Method": {method}}
+        if headers != "" {
+            h["Access-Control-Request-Headers"] = []string{headers}
+        }
+        return getServerTestResponse(s, "OPTIONS", "/items", "", h, nil)
+    }
+
+    resp := preflight("https://example.com", "POST", "content-type, x-token")
+    if resp.statusCode != 204 {
+        t.Fatalf("expected preflight status 204, got %d", resp.statusCode)
+    }
+    if v := resp.headers["Access-Control-Allow-Origin"]; len(v) != 1 || v[0] != "https://example.com" {
+        t.Fatalf("unexpected Access-Control-Allow-Origin %v", v)
+    }
+    if v := resp.headers["Access-Control-Allow-Methods"]; len(v) != 1 || v[0] != "GET, POST, HEAD" {
+        t.Fatalf("unexpected Access-Control-Allow-Methods %v", v)
+    }
+    if v := resp.headers["Access-Control-Allow-Headers"]; len(v) != 1 || v[0] != "Content-Type, X-Token" {
+        t.Fatalf("unexpected Access-Control-Allow-Headers %v", v)
+    }
+    if v := resp.headers["Access-Control-Max-Age"]; len(v) != 1 || v[0] != "600" {
+        t.Fatalf("unexpected Access-Control-Max-Age %v", v)
+    }
+
+    resp = preflight("https://api.example.org", "GET", "")
+    if len(resp.headers["Access-Control-Allow-Origin"]) != 1 {
+        t.Fatalf("expected wildcard subdomain origin to be allowed")
+    }
+    for _, bad := range [][]string{{"https://evil.com", "GET", ""}, {"https://example.com", "DELETE", ""}, {"https://example.com", "GET", "X-Other"}} {
+        resp = preflight(bad[0], bad[1], bad[2])
+        if _, ok := resp.headers["Access-Control-Allow-Origin"]; ok {
+            t.Fatalf("expected preflight %v to be refused", bad)
+        }
+    }
+
+    resp = getServerTestResponse(s, "GET", "/items", "", map[string][]string{"Origin": {"https://example.com"}}, nil)
+    if resp.body != "items" || resp.headers["Access-Control-Allow-Credentials"][0] != "true" ||
+        resp.headers["Access-Control-Expose-Headers"][0] != "X-Total" {
+        t.Fatalf("unexpected CORS response %v", resp.headers)
+    }
+    if v := resp.headers["Vary"]; len(v) != 1 || v[0] != "Origin" {
+        t.Fatalf("expected Vary: Origin, got %v", v)
+    }
+
+    resp = getServerTestResponse(s, "OPTIONS", "/missing", "", map[string][]string{"Origin": {"https://example.com"}, "Access-Control-Request-Method": {"GET"}}, nil)
+    if resp.statusCode != 404 {
+        t.Fatalf("expected preflight for unknown path to 404, got %d", resp.statusCode)
+    }
+}
+
+func TestSecureHeaders(t *testing.T) {
+    s := newTestServer()
+    s.Use(SecureHeaders(nil))
+    s.Get("/page", func(ctx *Context) string { return ctx.CSPNonce() })
+
+    resp := getServerTestResponse(s, "GET", "/page", "", nil, nil)
+    nonce := resp.body
+    if nonce == "" {
+        t.Fatalf("expected a CSP nonce")
+    }
+    csp := resp.headers["Content-Security-Policy"]
+    if len(csp) != 1 || !strings.Contains(csp[0], "'nonce-"+nonce+"'") {
+        t.Fatalf("expected nonce in policy, got %v", csp)
+    }
+    if resp.headers["X-Content-Type-Options"][0] != "nosniff" || resp.headers["X-Frame-Options"][0] != "SAMEORIGIN" {
+        t.Fatalf("missing security headers %v", resp.headers)
+    }
+    if _, ok := resp.headers["Strict-Transport-Security"]; ok {
+        t.Fatalf("Strict-Transport-Security sent over plain HTTP")
+    }
+    if resp2 := getServerTestResponse(s, "GET", "/page", "", nil, nil); resp2.body == nonce {
+        t.Fatalf("nonce reused between requests")
+    }
+}
+
+func TestCSPReportOnly(t *testing.T) {
+    var reports []*CSPReport
+    s := newTestServer()
+    s.Use(SecureHeaders(&SecureHeadersConfig{
+        ContentSecurityPolicy: "default-src 'self'",
+        CSPReportOnly:         true,
+        ReportPath:            "/csp-report",
+        ReportHandler:         func(ctx *Context, r *CSPReport) { reports = append(reports, r) },
+    }))
+    s.Get("/", func() string { return "index" })
+
+    resp := getServerTestResponse(s, "GET", "/", "", nil, nil)
+    if v := resp.headers["Content-Security-Policy-Report-Only"]; len(v) != 1 || v[0] != "default-src 'self'; report-uri /csp-report" {
+        t.Fatalf("unexpected report-only policy %v", v)
+    }
+    if _, ok := resp.headers["Content-Security-Policy"]; ok {
+        t.Fatalf("enforcing policy sent in report-only mode")
+    }
+
+    report := `{"csp-report":{"document-uri":"http://127.0.0.1/","violated-directive":"script-src","blocked-uri":"inline"}}`
+    headers := map[string][]string{"Content-Type": {"application/csp-report"}}
+    resp = getServerTestResponse(s, "POST", "/csp-report", report, headers, nil)
+    if resp.statusCode != 204 {
+        t.Fatalf("expected 204 from report endpoint, got %d", resp.statusCode)
+    }
+    if len(reports) != 1 || reports[0].ViolatedDirective != "script-src" {
+        t.Fatalf("report not collected: %v", reports)
+    }
+}
+
+func TestBasicAuth(t *testing.T) {
+    s := newTestServer()
+    users := map[string]string{"admin": "s3cret"}
+    admin := s.Group("/admin", BasicAuth("admin area", func(user string) (string, bool) {
+        p, ok := users[user]
+        return p, ok
+    }))
+    admin.Get("/", func(ctx *Context) string { return "hello " + ctx.User() })
+
+    resp := getServerTestResponse(s, "GET", "/admin/", "", nil, nil)
+    if resp.statusCode != 401 || resp.headers["Www-Authenticate"][0] != `Basic realm="admin area", charset="UTF-8"` {
+        t.Fatalf("expected Basic challenge, got %d %v", resp.statusCode, resp.headers)
+    }
+    for _, creds := range []string{"admin:wrong", "nobody:s3cret"} {
+        h := map[string][]string{"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte(creds))}}
+        if resp = getServerTestResponse(s, "GET", "/admin/", "", h, nil); resp.statusCode != 401 {
+            t.Fatalf("expected %q to be refused, got %d", creds, resp.statusCode)
+        }
+    }
+    h := map[string][]string{"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte("admin:s3cret"))}}
+    resp = getServerTestResponse(s, "GET", "/admin/", "", h, nil)
+    if resp.statusCode != 200 || resp.body != "hello admin" {
+        t.Fatalf("expected successful login, got %d %q", resp.statusCode, resp.body)
+    }
+}
+
+func digestResponse(h func() hash.Hash, user, realm, password, method, uri string, params map[string]string, nc string) string {
+    hexHash := func(s string) string {
+        hh := h()
+        hh.Write([]byte(s))
+        return hex.EncodeToString(hh.Sum(nil))
+    }
+    ha1 := hexHash(user + ":" + realm + ":" + password)
+    ha2 := hexHash(method + ":" + uri)
+    response := hexHash(ha1 + ":" + params["nonce"] + ":" + nc + ":abcdef:auth:" + ha2)
+    return fmt.Sprintf(`Digest username=%q, realm=%q, nonce=%q, uri=%q, algorithm=%s, qop=auth, nc=%s, cnonce="abcdef", response=%q, opaque=%q`,
+        user, realm, params["nonce"], uri, params["algorithm"], nc, response, params["opaque"])
+}
+
+func TestDigestAuth(t *testing.T) {
+    s := newTestServer()
+    s.Use(DigestAuth(&DigestAuthConfig{
+        Realm:       "api",
+        Credentials: func(user string) (string, bool) { return "pw", user == "bob" },
+    }))
+    s.Get("/data", func(ctx *Context) string { return ctx.User() })
+
+    resp := getServerTestResponse(s, "GET", "/data?x=1", "", nil, nil)
+    challenges := resp.headers["Www-Authenticate"]
+    if resp.statusCode != 401 || len(challenges) != 2 || !strings.Contains(challenges[0], "algorithm=SHA-256") {
+        t.Fatalf("expected SHA-256 and MD5 challenges, got %v", challenges)
+    }
+
+    //both challenges share a nonce, so each algorithm continues the nonce count
+    for i, h := range []func() hash.Hash{sha256.New, md5.New} {
+        params := parseAuthParams(strings.TrimPrefix(challenges[i], "Digest "))
+        auth := digestResponse(h, "bob", "api", "pw", "GET", "/data?x=1", params, fmt.Sprintf("%08x", 2*i+1))
+        resp = getServerTestResponse(s, "GET", "/data?x=1", "", map[string][]string{"Authorization": {auth}}, nil)
+        if resp.statusCode != 200 || resp.body != "bob" {
+            t.Fatalf("expected %s digest to be accepted, got %d", params["algorithm"], resp.statusCode)
+        }
+        //replaying the same nonce count must fail
+        resp = getServerTestResponse(s, "GET", "/data?x=1", "", map[string][]string{"Authorization": {auth}}, nil)
+        if resp.statusCode != 401 {
+            t.Fatalf("expected replayed %s digest to be refused, got %d", params["algorithm"], resp.statusCode)
+        }
+        auth = digestResponse(h, "bob", "api", "wrong", "GET", "/data?x=1", params, fmt.Sprintf("%08x", 2*i+2))
+        resp = getServerTestResponse(s, "GET", "/data?x=1", "", map[string][]string{"Authorization": {auth}}, nil)
+        if resp.statusCode != 401 {
+            t.Fatalf("expected wrong password to be refused, got %d", resp.statusCode)
+        }
+    }
+}
+
+func TestJWT(t *testing.T) {
+    secret := []byte("jwt secret")
+    s := newTestServer()
+    s.Use(JWT(&JWTConfig{Key: secret, Issuer: "web.go", Audience: "api", Leeway: time.Minute, CookieName: "token"}))
+    s.Get("/me", func(ctx *Context) string { return ctx.User() + " " + ctx.Claims().String("role") })
+
+    now := time.Now().Unix()
+    sign := func(claims Claims) string {
+        token, err := SignJWT(claims, "HS256", secret, "")
+        if err != nil {
+            t.Fatalf("SignJWT: %v", err)
+        }
+        return token
+    }
+    bearer := func(token string) map[string][]string {
+        return map[string][]string{"Authorization": {"Bearer " + token}}
+    }
+
+    valid := sign(Claims{"sub": "alice", "role": "admin", "iss": "web.go", "aud": []string{"api", "web"}, "exp": now + 60})
+    resp := getServerTestResponse(s, "GET", "/me", "", bearer(valid), nil)
+    if resp.statusCode != 200 || resp.body != "alice admin" {
+        t.Fatalf("expected valid token to be accepted, got %d %q", resp.statusCode, resp.body)
+    }
+    resp = getServerTestResponse(s, "GET", "/me", "", nil, makeCookie(map[string]string{"token": valid}))
+    if resp.statusCode != 200 {
+        t.Fatalf("expected token cookie to be accepted, got %d", resp.statusCode)
+    }
+    //within the leeway
+    skewed := sign(Claims{"sub": "alice", "iss": "web.go", "aud": "api", "exp": now - 30})
+    if resp = getServerTestResponse(s, "GET", "/me", "", bearer(skewed), nil); resp.statusCode != 200 {
+        t.Fatalf("expected token within leeway to be accepted, got %d", resp.statusCode)
+    }
+
+    invalid := []string{
+        sign(Claims{"sub": "alice", "iss": "web.go", "aud": "api", "exp": now - 120}),
+        sign(Claims{"sub": "alice", "iss": "web.go", "aud": "api", "nbf": now + 120}),
+        sign(Claims{"sub": "alice", "iss": "other", "aud": "api"}),
+        sign(Claims{"sub": "alice", "iss": "web.go", "aud": "other"}),
+        valid[:len(valid)-2] + "xx",
+        "not.a.token",
+    }
+    for _, token := range invalid {
+        resp = getServerTestResponse(s, "GET", "/me", "", bearer(token), nil)
+        if resp.statusCode != 401 || !strings.Contains(resp.headers["Www-Authenticate"][0], "invalid_token") {
+            t.Fatalf("expected token %q to be refused, got %d", token, resp.statusCode)
+        }
+    }
+    if resp = getServerTestResponse(s, "GET", "/me", "", nil, nil); resp.statusCode != 401 {
+        t.Fatalf("expected missing token to be refused, got %d", resp.statusCode)
+    }
+}
+
+func TestJWKS(t *testing.T) {
+    rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+    ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    edPub, edKey, _ := ed25519.GenerateKey(rand.Reader)
+    b64 := base64.RawURLEncoding.EncodeToString
+    ecX, ecY := make([]byte, 32), make([]byte, 32)
+    ecKey.X.FillBytes(ecX)
+    ecKey.Y.FillBytes(ecY)
+
+    dir, _ := ioutil.TempDir("", "webjwks")
+    defer os.RemoveAll(dir)
+    file := filepath.Join(dir, "jwks.json")
+    keys := []map[string]string{
+        {"kty": "RSA", "kid": "rsa", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+        {"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ecX), "y": b64(ecY)},
+        //skipped
+        {"kty": "EC", "kid": "p384", "crv": "P-384", "x": b64(make([]byte, 48)), "y": b64(make([]byte, 48))},
+        {"kty": "RSA", "kid": "enc", "use": "enc", "alg": "RSA-OAEP", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+        {"kty": "oct", "kid": "empty", "k": ""},
+    }
+    writeKeys := func(mod time.Time) {
+        data, _ := json.Marshal(map[string]interface{}{"keys": keys})
+        ioutil.WriteFile(file, data, 0600)
+        os.Chtimes(file, mod, mod)
+    }
+    writeKeys(time.Now().Add(-time.Hour))
+
+    var logged bytes.Buffer
+    set, err := LoadJWKS(file, time.Nanosecond, log.New(&logged, "", 0))
+    if err != nil {
+        t.Fatalf("LoadJWKS: %v", err)
+    }
+    if !strings.Contains(logged.String(), `"p384"`) || !strings.Contains(logged.String(), `"empty"`) || strings.Contains(logged.String(), `"enc"`) {
+        t.Fatalf("expected unsupported keys to be logged, got %q", logged.String())
+    }
+    s := newTestServer()
+    s.Use(JWT(&JWTConfig{KeySet: set}))
+    s.Get("/me", func(ctx *Context) string { return ctx.User() })
+
+    check := func(alg string, key interface{}, kid string, status int) {
+        token, err := SignJWT(Claims{"sub": kid}, alg, key, kid)
+        if err != nil {
+            t.Fatalf("SignJWT(%s): %v", alg, err)
+        }
+        resp := getServerTestResponse(s, "GET", "/me", "", map[string][]string{"Authorization": {"Bearer " + token}}, nil)
+        if resp.statusCode != status {
+            t.Fatalf("%s token with kid %q: expected %d got %d", alg, kid, status, resp.statusCode)
+        }
+    }
+    check("RS256", rsaKey, "rsa", 200)
+    check("ES256", ecKey, "ec", 200)
+    check("ES256", ecKey, "rsa", 401)
+    check("EdDSA", edKey, "ed", 401)
+    check("RS256", rsaKey, "enc", 401)
+    check("HS256", []byte{}, "empty", 401)
+
+    keys = append(keys, map[string]string{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": b64(edPub)})
+    writeKeys(time.Now())
+    check("EdDSA", edKey, "ed", 200)
+}
+
+func TestAuthorization(t *testing.T) {
+    secret := []byte("jwt secret")
+    s := newTestServer()
+    api := s.Group("/api", JWT(&JWTConfig{Key: secret}))
+    api.Get("/public", func() string { return "public" })
+    api.Require(Access{Roles: []string{"admin"}, Permissions: []string{"orders:write"}}).Post("/orders", func() string { return "created" })
+    s.Require(Access{}).Get("/profile", func(ctx *Context) string { return ctx.Principal().Name })
+    s.Require(Access{Roles: []string{"admin"}}).Group("/admin", JWT(&JWTConfig{Key: secret})).Require(Access{Permissions: []string{"reports:read"}}).Get("/reports", func() string { return "reports" })
+
+    token := func(claims Claims) map[string][]string {
+        tok, _ := SignJWT(claims, "HS256", secret, "")
+        return map[string][]string{"Authorization": {"Bearer " + tok}}
+    }
+
+    if resp := getServerTestResponse(s, "POST", "/api/orders", "", token(Claims{"sub": "bob"}), nil); resp.statusCode != 403 {
+        t.Fatalf("expected 403 for principal without role, got %d", resp.statusCode)
+    }
+    if resp := getServerTestResponse(s, "POST", "/api/orders", "", token(Claims{"sub": "bob", "roles": []string{"admin"}}), nil); resp.statusCode != 200 {
+        t.Fatalf("expected admin role to be allowed, got %d", resp.statusCode)
+    }
+    if resp := getServerTestResponse(s, "POST", "/api/orders", "", token(Claims{"sub": "bob", "scope": "orders:read orders:write"}), nil); resp.statusCode != 200 {
+        t.Fatalf("expected orders:write permission to be allowed, got %d", resp.statusCode)
+    }
+    if resp := getServerTestResponse(s, "POST", "/api/orders", "", token(Claims{"scope": "orders:write"}), nil); resp.statusCode != 200 {
+        t.Fatalf("expected token without sub to be allowed by its scope, got %d", resp.statusCode)
+    }
+    if resp := getServerTestResponse(s, "POST", "/api/orders", "", token(Claims{"scope": "orders:read"}), nil); resp.statusCode != 403 {
+        t.Fatalf("expected token without sub and permission to be refused, got %d", resp.statusCode)
+    }
+    if resp := getServerTestResponse(s, "GET", "/api/public", "", token(Claims{"sub": "bob"}), nil); resp.statusCode != 200 {
+        t.Fatalf("expected route without requirements to be allowed, got %d", resp.statusCode)
+    }
+    if resp := getServerTestResponse(s, "GET", "/profile", "", nil, nil); resp.statusCode != 401 {
+        t.Fatalf("expected 401 for anonymous request, got %d", resp.statusCode)
+    }
+    for _, test := range []struct {
+        claims   Claims
+        expected int
+    }{
+        {Claims{"sub": "bob", "scope": "reports:read"}, 403},
+        {Claims{"sub": "bob", "roles": []string{"admin"}}, 403},
+        {Claims{"sub": "bob", "roles": []string{"admin"}, "scope": "reports:read"}, 200},
+    } {
+        if resp := getServerTestResponse(s, "GET", "/admin/reports", "", token(test.claims), nil); resp.statusCode != test.expected {
+            t.Fatalf("%v: expected nested requirements to add up to %d, got %d", test.claims, test.expected, resp.statusCode)
+        }
+    }
+
+    s.Policy = func(ctx *Context, p *Principal, access *Access) bool { return p.Name == "root" }
+    if resp := getServerTestResponse(s, "POST", "/api/orders", "", token(Claims{"sub": "root"}), nil); resp.statusCode != 200 {
+        t.Fatalf("expected custom policy to allow root, got %d", resp.statusCode)
+    }
+
+    var dump bytes.Buffer
+    s.DumpAccess(&dump)
+    lines := strings.Split(strings.TrimSpace(dump.String()), "\n")
+    if len(lines) != 4 || !strings.HasSuffix(lines[0], "public") ||
+        !strings.HasSuffix(lines[1], "role:admin | permission:orders:write") || !strings.HasSuffix(lines[2], "authenticated") ||
+        !strings.HasSuffix(lines[3], "(role:admin) & (permission:reports:read)") {
+        t.Fatalf("unexpected access dump:\n%s", dump.String())
+    }
+}
+
+// newTestCert returns a certificate for cn signed by parent, or a
+// self-signed CA certificate if parent is nil.
+func newTestCert(t *testing.T, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+    key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+    tmpl := &x509.Certificate{
+        SerialNumber: serial,
+        Subject:      pkix.Name{CommonName: cn},
+        DNSNames:     []string{cn},
+        NotBefore:    time.Now().Add(-time.Hour),
+        NotAfter:     time.Now().Add(time.Hour),
+        ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+        KeyUsage:     x509.KeyUsageDigitalSignature,
+    }
+    if parent == nil {
+        tmpl.IsCA = true
+        tmpl.BasicConstraintsValid = true
+        tmpl.KeyUsage |= x509.KeyUsageCertSign
+        parent, parentKey = tmpl, key
+    }
+    der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+    if err != nil {
+        t.Fatalf("CreateCertificate: %v", err)
+    }
+    cert, _ := x509.ParseCertificate(der)
+    return cert, key
+}
+
+func TestClientCert(t *testing.T) {
+    ca, caKey := newTestCert(t, "test ca", nil, nil)
+    client, clientKey := newTestCert(t, "orders.internal", ca, caKey)
+    other, _ := newTestCert(t, "billing.internal", ca, caKey)
+    rogueCA, rogueKey := newTestCert(t, "rogue ca", nil, nil)
+    rogue, _ := newTestCert(t, "orders.internal", rogueCA, rogueKey)
+
+    dir, _ := ioutil.TempDir("", "webmtls")
+    defer os.RemoveAll(dir)
+    caFile := filepath.Join(dir, "ca.pem")
+    ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0600)
+
+    s := newTestServer()
+    s.Config.ClientCAFile = caFile
+    s.Config.ClientCertHeader = "X-Client-Cert"
+    s.Group("", RequireClientCert("orders.internal")).Get("/orders", func(ctx *Context) string {
+        return ctx.User() + " " + ctx.ClientCert().DNSNames[0]
+    })
+
+    //forwarded by a proxy over SCGI
+    scgi := func(cert *x509.Certificate) *testResponse {
+        escaped := url.PathEscape(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})))
+        req := buildTestScgiRequest("GET", "/orders", "", map[string][]string{"X-Client-Cert": {escaped}})
+        var output bytes.Buffer
+        s.handleScgiRequest(&ioBuffer{input: req, output: &output})
+        return buildTestResponse(&output)
+    }
+    if resp := scgi(client); resp.statusCode != 200 || resp.body != "orders.internal orders.internal" {
+        t.Fatalf("expected forwarded certificate to be accepted, got %d %q", resp.statusCode, resp.body)
+    }
+    if resp := scgi(other); resp.statusCode != 403 {
+        t.Fatalf("expected identity not in allow list to be refused, got %d", resp.statusCode)
+    }
+    if resp := scgi(rogue); resp.statusCode != 403 {
+        t.Fatalf("expected certificate from unknown CA to be refused, got %d", resp.statusCode)
+    }
+    //the header is ignored from untrusted peers
+    escaped := url.PathEscape(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: client.Raw})))
+    if resp := getServerTestResponse(s, "GET", "/orders", "", map[string][]string{"X-Client-Cert": {escaped}}, nil); resp.statusCode != 403 {
+        t.Fatalf("expected header from untrusted peer to be ignored, got %d", resp.statusCode)
+    }
+    //forwarded certificates cannot be verified without the CAs
+    s.Config.ClientCAFile = ""
+    if resp := scgi(client); resp.statusCode != 403 {
+        t.Fatalf("expected forwarded certificate to be ignored without ClientCAFile, got %d", resp.statusCode)
+    }
+    s.Config.ClientCAFile = caFile
+
+    //directly over TLS
+    config, err := s.clientAuthConfig(nil)
+    if err != nil {
+        t.Fatalf("clientAuthConfig: %v", err)
+    }
+    ts := httptest.NewUnstartedServer(s)
+    ts.TLS = config
+    ts.StartTLS()
+    defer ts.Close()
+    httpClient := ts.Client()
+    httpClient.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{
+        {Certificate: [][]byte{client.Raw}, PrivateKey: clientKey},
+    }
+    res, err := httpClient.Get(ts.URL + "/orders")
+    if err != nil {
+        t.Fatalf("TLS request failed: %v", err)
+    }
+    body, _ := ioutil.ReadAll(res.Body)
+    res.Body.Close()
+    if res.StatusCode != 200 || string(body) != "orders.internal orders.internal" {
+        t.Fatalf("expected TLS client certificate to be accepted, got %d %q", res.StatusCode, body)
+    }
+}
+
+func writeTestCert(t *testing.T, dir string, name string, cert *x509.Certificate, key *ecdsa.PrivateKey, mod time.Time) (string, string) {
+    certFile := filepath.Join(dir, name+".crt")
+    keyFile := filepath.Join(dir, name+".key")
+    der, _ := x509.MarshalECPrivateKey(key)
+    ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0600)
+    ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+    os.Chtimes(certFile, mod, mod)
+    os.Chtimes(keyFile, mod, mod)
+    return certFile, keyFile
+}
+
+func TestCertManager(t *testing.T) {
+    dir, _ := ioutil.TempDir("", "webcerts")
+    defer os.RemoveAll(dir)
+    ca, caKey := newTestCert(t, "test ca", nil, nil)
+    a, aKey := newTestCert(t, "a.example", ca, caKey)
+    b, bKey := newTestCert(t, "*.b.example", ca, caKey)
+
+    var logs bytes.Buffer
+    m := NewCertManager()
+    m.Logger = log.New(&logs, "", 0)
+    past := time.Now().Add(-time.Hour)
+    aCert, aKeyFile := writeTestCert(t, dir, "a", a, aKey, past)
+    bCert, bKeyFile := writeTestCert(t, dir, "b", b, bKey, past)
+    if err := m.Add(aCert, aKeyFile); err != nil {
+        t.Fatalf("Add: %v", err)
+    }
+    if err := m.Add(bCert, bKeyFile); err != nil {
+        t.Fatalf("Add: %v", err)
+    }
+    if !strings.Contains(logs.String(), "a.crt expires in 0 days") {
+        t.Fatalf("expected expiry warning, got %q", logs.String())
+    }
+
+    serial := func(name string) *big.Int {
+        cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+        if err != nil {
+            t.Fatalf("GetCertificate(%q): %v", name, err)
+        }
+        return cert.Leaf.SerialNumber
+    }
+    if serial("a.example").Cmp(a.SerialNumber) != 0 || serial("x.b.example").Cmp(b.SerialNumber) != 0 ||
+        serial("unknown.example").Cmp(a.SerialNumber) != 0 {
+        t.Fatalf("wrong certificate selected by server name")
+    }
+
+    //a broken renewal keeps the old certificate
+    ioutil.WriteFile(aCert, []byte("garbage"), 0600)
+    if err := m.Reload(); err == nil {
+        t.Fatalf("expected reload of broken certificate to fail")
+    }
+    if serial("a.example").Cmp(a.SerialNumber) != 0 {
+        t.Fatalf("broken certificate replaced the old one")
+    }
+
+    renewed, renewedKey := newTestCert(t, "a.example", ca, caKey)
+    writeTestCert(t, dir, "a", renewed, renewedKey, time.Now())
+    if err := m.Reload(); err != nil {
+        t.Fatalf("Reload: %v", err)
+    }
+    if serial("a.example").Cmp(renewed.SerialNumber) != 0 {
+        t.Fatalf("renewed certificate not served after reload")
+    }
+}
+
+// acmeStandIn is a minimal ACME server for offline tests. It validates
+// challenges by calling validate instead of connecting to the domain.
+type acmeStandIn struct {
+    t        *testing.T
+    srv      *httptest.Server
+    ca       *x509.Certificate
+    caKey    *ecdsa.PrivateKey
+    validate func(typ string, domain string, token string, keyAuth string) bool
+
+    mu       sync.Mutex
+    nonces   map[string]bool
+    badNonce bool
+    accounts map[string]*ecdsa.PublicKey
+    authzs   map[string]*acmeAuthorization
+    orders   map[string]*acmeOrder
+    certs    map[string][]byte
+    seq      int
+}
+
+func newACMEStandIn(t *testing.T) *acmeStandIn {
+    a := &acmeStandIn{t: t, nonces: map[string]bool{}, badNonce: true, accounts: map[string]*ecdsa.PublicKey{},
+        authzs: map[string]*acmeAuthorization{}, orders: map[string]*acmeOrder{}, certs: map[string][]byte{}}
+    a.ca, a.caKey = newTestCert(t, "acme stand-in ca", nil, nil)
+    a.srv = httptest.NewServer(http.HandlerFunc(a.serve))
+    return a
+}
+
+func (a *acmeStandIn) newNonce() string {
+    a.seq++
+    n := fmt.Sprintf("nonce-%d", a.seq)
+    a.nonces[n] = true
+    return n
+}
+
+func (a *acmeStandIn) problem(w http.ResponseWriter, typ string, status int) {
+    w.Header().Set("Content-Type", "application/problem+json")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(map[string]string{"type": "urn:ietf:params:acme:error:" + typ, "detail": typ})
+}
+
+func (a *acmeStandIn) serve(w http.ResponseWriter, req *http.Request) {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    base := a.srv.URL
+    w.Header().Set("Replay-Nonce", a.newNonce())
+    if req.URL.Path == "/dir" {
+        json.NewEncoder(w).Encode(acmeDirectory{NewNonce: base + "/nonce", NewAccount: base + "/account", NewOrder: base + "/order"})
+        return
+    }
+    if req.URL.Path == "/nonce" {
+        return
+    }
+
+    //verify the JWS
+    var jws map[string]string
+    json.NewDecoder(req.Body).Decode(&jws)
+    var protected struct {
+        Nonce string            `json:"nonce"`
+        URL   string            `json:"url"`
+        Kid   string            `json:"kid"`
+        JWK   map[string]string `json:"jwk"`
+    }
+    decodeJWTPart(jws["protected"], &protected)
+    if !a.nonces[protected.Nonce] || a.badNonce {
+        a.badNonce = false
+        a.problem(w, "badNonce", 400)
+        return
+    }
+    delete(a.nonces, protected.Nonce)
+    if protected.URL != base+req.URL.Path {
+        a.problem(w, "unauthorized", 403)
+        return
+    }
+    key := a.accounts[protected.Kid]
+    if protected.JWK != nil {
+        x, _ := base64.RawURLEncoding.DecodeString(protected.JWK["x"])
+        y, _ := base64.RawURLEncoding.DecodeString(protected.JWK["y"])
+        key = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+    }
+    sig, _ := base64.RawURLEncoding.DecodeString(jws["signature"])
+    digest := sha256.Sum256([]byte(jws["protected"] + "." + jws["payload"]))
+    if key == nil || len(sig) != 64 || !ecdsa.Verify(key, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+        a.problem(w, "unauthorized", 403)
+        return
+    }
+    payload, _ := base64.RawURLEncoding.DecodeString(jws["payload"])
+
+    parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+    switch parts[0] {
+    case "account":
+        kid := base + "/account/1"
+        a.accounts[kid] = key
+        w.Header().Set("Location", kid)
+        w.WriteHeader(201)
+        w.Write([]byte(`{"status":"valid"}`))
+    case "order":
+        if len(parts) == 2 {
+            json.NewEncoder(w).Encode(a.orders[parts[1]])
+            return
+        }
+        var newOrder struct {
+            Identifiers []struct{ Value string }
+        }
+        json.Unmarshal(payload, &newOrder)
+        id := fmt.Sprint(a.seq)
+        order := &acmeOrder{Status: "pending", Finalize: base + "/finalize/" + id}
+        for i, ident := range newOrder.Identifiers {
+            authzID := fmt.Sprintf("%s-%d", id, i)
+            authz := &acmeAuthorization{Status: "pending"}
+            authz.Identifier.Value = ident.Value
+            for _, typ := range []string{"http-01", "tls-alpn-01"} {
+                authz.Challenges = append(authz.Challenges, acmeChallenge{
+                    Type: typ, URL: base + "/chal/" + authzID + "/" + typ, Token: "token-" + authzID, Status: "pending"})
+            }
+            a.authzs[authzID] = authz
+            order.Authorizations = append(order.Authorizations, base+"/authz/"+authzID)
+        }
+        a.orders[id] = order
+        w.Header().Set("Location", base+"/order/"+id)
+        w.WriteHeader(201)
+        json.NewEncoder(w).Encode(order)
+    case "authz":
+        json.NewEncoder(w).Encode(a.authzs[parts[1]])
+    case "chal":
+        authz := a.authzs[parts[1]]
+        c := (&acmeClient{key: &ecdsa.PrivateKey{PublicKey: *key}}).thumbprint()
+        keyAuth := "token-" + parts[1] + "." + c
+        a.mu.Unlock()
+        ok := a.validate(parts[2], authz.Identifier.Value, "token-"+parts[1], keyAuth)
+        a.mu.Lock()
+        if ok {
+            authz.Status = "valid"
+        } else {
+            authz.Status = "invalid"
+        }
+        w.Write([]byte(`{"status":"processing"}`))
+    case "finalize":
+        order := a.orders[parts[1]]
+        for _, u := range order.Authorizations {
+            if a.authzs[u[strings.LastIndex(u, "/")+1:]].Status != "valid" {
+                a.problem(w, "orderNotReady", 403)
+                return
+            }
+        }
+        var f struct{ CSR string }
+        json.Unmarshal(payload, &f)
+        der, _ := base64.RawURLEncoding.DecodeString(f.CSR)
+        csr, err := x509.ParseCertificateRequest(der)
+        if err != nil || csr.CheckSignature() != nil {
+            a.problem(w, "badCSR", 400)
+            return
+        }
+        tmpl := &x509.Certificate{
+            SerialNumber: big.NewInt(int64(a.seq)),
+            Subject:      csr.Subject,
+            DNSNames:     csr.DNSNames,
+            NotBefore:    time.Now().Add(-time.Hour),
+            NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+            ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+        }
+        certDER, _ := x509.CreateCertificate(rand.Reader, tmpl, a.ca, csr.PublicKey, a.caKey)
+        a.certs[parts[1]] = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}),
+            pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: a.ca.Raw})...)
+        order.Status = "processing"
+        order.Certificate = base + "/cert/" + parts[1]
+        json.NewEncoder(w).Encode(order)
+        //the certificate becomes available on the next poll
+        order.Status = "valid"
+    case "cert":
+        w.Header().Set("Content-Type", "application/pem-certificate-chain")
+        w.Write(a.certs[parts[1]])
+    default:
+        a.problem(w, "malformed", 404)
+    }
+}
+
+func TestAutoTLS(t *testing.T) {
+    a := newACMEStandIn(t)
+    defer a.srv.Close()
+    dir, _ := ioutil.TempDir("", "webacme")
+    defer os.RemoveAll(dir)
+
+    s := newTestServer()
+    s.Get("/(.*)", func(p string) string { return "route " + p })
+    s.Config.ACMEDirectory = a.srv.URL + "/dir"
+    s.Config.ACMECacheDir = filepath.Join(dir, "http")
+    s.Config.ACMEPollInterval = time.Millisecond
+    domains := []string{"example.test", "www.example.test"}
+
+    a.validate = func(typ string, domain string, token string, keyAuth string) bool {
+        if typ != "http-01" {
+            return false
+        }
+        //the challenge is answered by the router, ahead of user routes
+        resp := getServerTestResponse(s, "GET", acmeChallengePath+token, "", nil, nil)
+        return resp.statusCode == 200 && resp.body == keyAuth
+    }
+    m, err := s.newAutoCert(domains)
+    if err != nil {
+        t.Fatalf("newAutoCert: %v", err)
+    }
+    s.acme = m
+    if _, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.test"}); err == nil {
+        t.Fatalf("expected no certificate before issuance")
+    }
+    if err := m.obtain(); err != nil {
+        t.Fatalf("obtain: %v", err)
+    }
+    cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "www.example.test"})
+    if err != nil || cert.Leaf.VerifyHostname("www.example.test") != nil {
+        t.Fatalf("expected issued certificate, got %v", err)
+    }
+    if resp := getServerTestResponse(s, "GET", acmeChallengePath+"token-1-0", "", nil, nil); resp.statusCode != 404 {
+        t.Fatalf("expected finished challenge to be removed, got %d", resp.statusCode)
+    }
+
+    //a new manager uses the cached certificate
+    cached, err := s.newAutoCert(domains)
+    if err != nil || cached.cert == nil || cached.cert.Leaf.SerialNumber.Cmp(cert.Leaf.SerialNumber) != 0 {
+        t.Fatalf("expected cached certificate to be loaded")
+    }
+
+    s.Config.ACMEChallenge = "tls-alpn-01"
+    s.Config.ACMECacheDir = filepath.Join(dir, "alpn")
+    m, _ = s.newAutoCert(domains[:1])
+    a.validate = func(typ string, domain string, token string, keyAuth string) bool {
+        hello := &tls.ClientHelloInfo{ServerName: domain, SupportedProtos: []string{acmeALPNProto}}
+        cert, err := m.GetCertificate(hello)
+        if typ != "tls-alpn-01" || err != nil {
+            return false
+        }
+        leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+        digest := sha256.Sum256([]byte(keyAuth))
+        want, _ := asn1.Marshal(digest[:])
+        for _, ext := range leaf.Extensions {
+            if ext.Id.Equal(idPeACMEIdentifier) && ext.Critical && bytes.Equal(ext.Value, want) {
+                return true
+            }
+        }
+        return false
+    }
+    if err := m.obtain(); err != nil {
+        t.Fatalf("obtain with tls-alpn-01: %v", err)
+    }
+
+    rec := httptest.NewRecorder()
+    req, _ := http.NewRequest("GET", "http://example.test/a/b?c=d", nil)
+    s.httpsRedirect("8443").ServeHTTP(rec, req)
+    if rec.Code != 301 || rec.Header().Get("Location") != "https://example.test:8443/a/b?c=d" {
+        t.Fatalf("unexpected redirect %d %q", rec.Code, rec.Header().Get("Location"))
+    }
+}
+
+func TestRenewalTime(t *testing.T) {
+    start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+    for _, test := range []struct {
+        lifetime, renewAfter time.Duration
+    }{
+        {90 * 24 * time.Hour, 60 * 24 * time.Hour},
+        {6 * 24 * time.Hour, 4 * 24 * time.Hour},
+        {time.Hour, 40 * time.Minute},
+    } {
+        cert := &x509.Certificate{NotBefore: start, NotAfter: start.Add(test.lifetime)}
+        if at := renewalTime(cert); !at.Equal(start.Add(test.renewAfter)) {
+            t.Fatalf("%v certificate: expected renewal after %v, got %v", test.lifetime, test.renewAfter, at.Sub(start))
+        }
+    }
+}
+
+func TestRateLimiter(t *testing.T) {
+    s := newTestServer()
+    s.Use(RateLimiter(&RateLimitConfig{
+        Limit: RateLimit{Requests: 2, Window: time.Minute},
+        Key:   KeyByHeader("X-Api-Key"),
+    }))
+    s.Get("/", func() string { return "index" })
+
+    key := func(k string) map[string][]string { return map[string][]string{"X-Api-Key": {k}} }
+    for i := 0; i < 2; i++ {
+        resp := getServerTestResponse(s, "GET", "/", "", key("a"), nil)
+        if resp.statusCode != 200 || resp.headers["Ratelimit-Remaining"][0] != strconv.Itoa(1-i) {
+            t.Fatalf("request %d: expected 200, got %d %v", i, resp.statusCode, resp.headers)
+        }
+    }
+    resp := getServerTestResponse(s, "GET", "/", "", key("a"), nil)
+    if resp.statusCode != 429 || resp.headers["Retry-After"][0] != "30" || resp.headers["Ratelimit-Limit"][0] != "2" {
+        t.Fatalf("expected 429 with Retry-After 30, got %d %v", resp.statusCode, resp.headers)
+    }
+    if resp = getServerTestResponse(s, "GET", "/", "", key("b"), nil); resp.statusCode != 200 {
+        t.Fatalf("expected other client to be allowed, got %d", resp.statusCode)
+    }
+
+    for _, limit := range []RateLimit{{Requests: 10}, {Window: time.Second}, {Requests: -1, Window: time.Second}} {
+        func() {
+            defer func() {
+                if recover() == nil {
+                    t.Fatalf("expected invalid limit %+v to panic", limit)
+                }
+            }()
+            RateLimiter(&RateLimitConfig{Limit: limit})
+        }()
+    }
+}
+
+func TestRequiredConfigs(t *testing.T) {
+    //middleware without sensible defaults refuse a nil config up front
+    for name, f := range map[string]func(){
+        "JWT":         func() { JWT(nil) },
+        "DigestAuth":  func() { DigestAuth(nil) },
+        "RateLimiter": func() { RateLimiter(nil) },
+    } {
+        func() {
+            defer func() {
+                if err, _ := recover().(string); !strings.Contains(err, name+" requires a config") {
+                    t.Fatalf("%s(nil): expected a panic, got %q", name, err)
+                }
+            }()
+            f()
+        }()
+    }
+    CSRF(nil)
+    CORS(nil)
+    SecureHeaders(nil)
+}
+
+func TestMemoryStore(t *testing.T) {
+    start := time.Unix(1000000, 0)
+    store := NewMemoryStore(0)
+    bucket := &RateLimit{Requests: 10, Window: 10 * time.Second, Algorithm: TokenBucket, Burst: 3}
+    allowed := func(limit *RateLimit, key string, at time.Duration) bool {
+        status, _ := store.Allow(key, limit, start.Add(at))
+        return status.Allowed
+    }
+    for i := 0; i < 3; i++ {
+        if !allowed(bucket, "tb", 0) {
+            t.Fatalf("token bucket: burst request %d refused", i)
+        }
+    }
+    if allowed(bucket, "tb", 0) || !allowed(bucket, "tb", time.Second) || allowed(bucket, "tb", time.Second) {
+        t.Fatalf("token bucket: expected one token per second after the burst")
+    }
+
+    window := &RateLimit{Requests: 4, Window: 10 * time.Second, Algorithm: SlidingWindow}
+    for i := 0; i < 4; i++ {
+        if !allowed(window, "sw", 5*time.Second) {
+            t.Fatalf("sliding window: request %d refused", i)
+        }
+    }
+    if allowed(window, "sw", 9*time.Second) {
+        t.Fatalf("sliding window: expected limit to be reached")
+    }
+    //windows start at the first request; halfway into the next window
+    //half of the previous count still applies: 4*0.5 = 2 requests left
+    if !allowed(window, "sw", 20*time.Second) || !allowed(window, "sw", 20*time.Second) || allowed(window, "sw", 20*time.Second) {
+        t.Fatalf("sliding window: expected previous window to be weighted")
+    }
+
+    small := NewMemoryStore(memoryStoreShards)
+    for i := 0; i < 10*memoryStoreShards; i++ {
+        small.Allow(strconv.Itoa(i), bucket, start)
+    }
+    if n := small.Len(); n > memoryStoreShards {
+        t.Fatalf("expected store to be bounded to %d keys, has %d", memoryStoreShards, n)
+    }
+
+    //with two keys per shard, a third key evicts the least recently used
+    lru := NewMemoryStore(2 * memoryStoreShards)
+    var keys []string
+    for i := 0; len(keys) < 3; i++ {
+        if key := strconv.Itoa(i); lru.shard(key) == lru.shard("0") {
+            keys = append(keys, key)
+        }
+    }
+    lru.Allow(keys[0], bucket, start)
+    lru.Allow(keys[1], bucket, start)
+    lru.Allow(keys[0], bucket, start)
+    lru.Allow(keys[2], bucket, start)
+    entries := lru.shard("0").entries
+    if _, ok := entries[keys[1]]; ok || len(entries) != 2 {
+        t.Fatalf("expected %q to be evicted, shard has %d keys", keys[1], len(entries))
+    }
+}
+
+func TestClientIP(t *testing.T) {
+    s := newTestServer()
+    var logged bytes.Buffer
+    s.SetLogger(log.New(&logged, "", 0))
+    s.Config.TrustedProxies = []string{"10.0.0.0/8", "2001:db8::1", "10.0.0.0/33"}
+    tests := []struct {
+        remote  string
+        headers map[string][]string
+        ip      string
+        scheme  string
+        host    string
+    }{
+        {"192.0.2.1:1234", nil, "192.0.2.1", "http", "127.0.0.1"},
+        //headers from untrusted peers are ignored
+        {"192.0.2.1:1234", map[string][]string{"X-Forwarded-For": {"203.0.113.9"}}, "192.0.2.1", "http", "127.0.0.1"},
+        {"10.0.0.2:1234", map[string][]string{"X-Forwarded-For": {"203.0.113.9, 10.0.0.3"}, "X-Forwarded-Proto": {"https"}, "X-Forwarded-Host": {"example.com"}},
+            "203.0.113.9", "https", "example.com"},
+        //a spoofed entry left of an untrusted hop is not used
+        {"10.0.0.2:1234", map[string][]string{"X-Forwarded-For": {"1.1.1.1, 203.0.113.9"}}, "203.0.113.9", "http", "127.0.0.1"},
+        {"10.0.0.2:1234", map[string][]string{"X-Real-Ip": {"203.0.113.7"}}, "203.0.113.7", "http", "127.0.0.1"},
+        {"[2001:db8::1]:443", map[string][]string{"Forwarded": {`for="[2001:db8:cafe::17]:4711";proto=https;host=example.org`}, "X-Forwarded-For": {"1.1.1.1"}},
+            "2001:db8:cafe::17", "https", "example.org"},
+        {"10.0.0.2:1234", map[string][]string{"Forwarded": {"for=198.51.100.17;proto=https, for=10.1.1.1;proto=http"}}, "198.51.100.17", "https", "127.0.0.1"},
+    }
+    for i, test := range tests {
+        req := buildTestRequest("GET", "/", "", test.headers, nil)
+        req.RemoteAddr = test.remote
+        ctx := &Context{Request: req, Server: s}
+        if ctx.ClientIP() != test.ip || ctx.Scheme() != test.scheme || ctx.Host() != test.host {
+            t.Fatalf("test %d: expected %s %s %s, got %s %s %s", i, test.ip, test.scheme, test.host, ctx.ClientIP(), ctx.Scheme(), ctx.Host())
+        }
+    }
+    if n := strings.Count(logged.String(), `"10.0.0.0/33"`); n != 1 {
+        t.Fatalf("expected invalid proxy address to be logged once, got %q", logged.String())
+    }
+}
+
+func proxyV2Header(src, dst string, sport, dport uint16, tlvs map[byte]string) []byte {
+    var body bytes.Buffer
+    body.Write(net.ParseIP(src).To4())
+    body.Write(net.ParseIP(dst).To4())
+    binary.Write(&body, binary.BigEndian, sport)
+    binary.Write(&body, binary.BigEndian, dport)
+    for typ, v := range tlvs {
+        body.WriteByte(typ)
+        binary.Write(&body, binary.BigEndian, uint16(len(v)))
+        body.WriteString(v)
+    }
+    header := append([]byte{}, proxyV2Signature...)
+    header = append(header, 0x21, 0x11, 0, 0)
+    binary.BigEndian.PutUint16(header[14:], uint16(body.Len()))
+    return append(header, body.Bytes()...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+    tests := []struct {
+        input  string
+        source string
+        err    bool
+    }{
+        {"PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nGET /", "192.0.2.1:56324", false},
+        {"PROXY TCP6 2001:db8::1 2001:db8::2 4711 443\r\nGET /", "[2001:db8::1]:4711", false},
+        {"PROXY UNKNOWN\r\nGET /", "", false},
+        {"PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n", "", true},
+        {"PROXY TCP4 2001:db8::1 198.51.100.1 1 2\r\n", "", true},
+        {"PROXY " + strings.Repeat("x", 200), "", true},
+        {string(proxyV2Header("203.0.113.5", "10.0.0.1", 1234, 80, nil)) + "GET /", "203.0.113.5:1234", false},
+        {"GET / HTTP/1.1\r\n", "", false},
+    }
+    for _, test := range tests {
+        r := bufio.NewReader(strings.NewReader(test.input))
+        h, err := readProxyHeader(r)
+        if (err != nil) != test.err {
+            t.Fatalf("%q: unexpected error %v", test.input, err)
+        }
+        if test.source != "" && (h == nil || h.Source.String() != test.source) {
+            t.Fatalf("%q: expected source %s, got %v", test.input, test.source, h)
+        }
+        if strings.HasSuffix(test.input, "GET /") {
+            if rest, _ := ioutil.ReadAll(r); string(rest) != "GET /" {
+                t.Fatalf("%q: header not consumed exactly, left %q", test.input, rest)
+            }
+        }
+    }
+
+    //CRC32C TLV
+    header := proxyV2Header("203.0.113.5", "10.0.0.1", 1234, 80, map[byte]string{ProxyTLVCRC32C: "\x00\x00\x00\x00"})
+    binary.BigEndian.PutUint32(header[len(header)-4:], crc32.Checksum(header, crc32.MakeTable(crc32.Castagnoli)))
+    if _, err := readProxyHeader(bufio.NewReader(bytes.NewReader(header))); err != nil {
+        t.Fatalf("valid checksum refused: %v", err)
+    }
+    header[len(header)-1]++
+    if _, err := readProxyHeader(bufio.NewReader(bytes.NewReader(header))); err == nil {
+        t.Fatalf("expected checksum mismatch")
+    }
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+    s := newTestServer()
+    s.Config.ProxyProtocol = &ProxyProtocolConfig{}
+    if l, err := s.listen("tcp", "127.0.0.1:0"); err == nil {
+        l.Close()
+        t.Fatalf("expected PROXY protocol without trusted sources to be refused")
+    }
+    s.Config.ProxyProtocol = &ProxyProtocolConfig{TrustedSources: []string{"127.0.0.1"}, HeaderTimeout: 100 * time.Millisecond}
+    s.Get("/", func(ctx *Context) string {
+        h := ctx.ProxyHeader()
+        return ctx.Request.RemoteAddr + " " + string(h.TLVs[ProxyTLVAuthority])
+    })
+    l, err := s.listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatalf("listen: %v", err)
+    }
+    defer l.Close()
+    go s.serveHTTP(l, s)
+
+    request := func(prefix []byte) string {
+        conn, err := net.Dial("tcp", l.Addr().String())
+        if err != nil {
+            t.Fatalf("dial: %v", err)
+        }
+        defer conn.Close()
+        conn.Write(prefix)
+        if prefix != nil {
+            conn.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+        }
+        resp, _ := ioutil.ReadAll(conn)
+        return string(resp)
+    }
+    resp := request(proxyV2Header("203.0.113.5", "10.0.0.1", 1234, 80, map[byte]string{ProxyTLVAuthority: "example.com"}))
+    if !strings.HasSuffix(resp, "203.0.113.5:1234 example.com") {
+        t.Fatalf("expected original source address, got %q", resp)
+    }
+    if resp = request([]byte{}); resp != "" {
+        t.Fatalf("expected connection without header to be closed, got %q", resp)
+    }
+    //no data before the header timeout
+    if resp = request(nil); resp != "" {
+        t.Fatalf("expected connection to be closed after header timeout, got %q", resp)
+    }
+}
+
+func TestBodyLimit(t *testing.T) {
+    s := newTestServer()
+    s.Config.MaxBodySize = 16
+    s.Post("/small", func(ctx *Context) string { return ctx.Params["a"] })
+    s.BodyLimit(1024).Post("/large", func(ctx *Context) string { return ctx.Params["a"] })
+
+    form := map[string][]string{"Content-Type": {"application/x-www-form-urlencoded"}}
+    body := "a=" + strings.Repeat("x", 100)
+    if resp := getServerTestResponse(s, "POST", "/small", body, form, nil); resp.statusCode != 413 {
+        t.Fatalf("expected 413 for oversized body, got %d", resp.statusCode)
+    }
+    if resp := getServerTestResponse(s, "POST", "/small", "a=b", form, nil); resp.body != "b" {
+        t.Fatalf("expected small body to be parsed, got %q", resp.body)
+    }
+    if resp := getServerTestResponse(s, "POST", "/large", body, form, nil); resp.statusCode != 200 || len(resp.body) != 100 {
+        t.Fatalf("expected route limit to override server limit, got %d %q", resp.statusCode, resp.body)
+    }
+
+    s.Config.MaxFormFields = 2
+    if resp := getServerTestResponse(s, "POST", "/large", "a=1&b=2&c=3", form, nil); resp.statusCode != 413 {
+        t.Fatalf("expected 413 for too many fields, got %d", resp.statusCode)
+    }
+}
+
+func TestMultipartUpload(t *testing.T) {
+    s := newTestServer()
+    s.Config.MultipartMemory = 64
+    s.Config.MaxFormFiles = 2
+    var spilled string
+    s.Post("/upload", func(ctx *Context) string {
+        if err := ctx.ParseForm(); err == ErrFormTooLarge {
+            ctx.Abort(413, err.Error())
+            return ""
+        }
+        var out []string
+        for _, f := range ctx.FormFiles("file") {
+            r, err := f.Open()
+            if err != nil {
+                return err.Error()
+            }
+            if tmp, ok := r.(*os.File); ok {
+                spilled = tmp.Name()
+            }
+            data, _ := ioutil.ReadAll(r)
+            r.Close()
+            out = append(out, fmt.Sprintf("%s:%d:%d", f.Filename, f.Size, len(data)))
+        }
+        //the form is also available through the http.Request
+        if _, fh, err := ctx.Request.FormFile("file"); err != nil || fh.Filename != "f0.txt" || len(ctx.Request.MultipartForm.File["file"]) != len(out) {
+            return "FormFile: " + fmt.Sprint(err)
+        }
+        return ctx.Params["name"] + " " + strings.Join(out, ",")
+    })
+
+    build := func(files int) (string, map[string][]string) {
+        var buf bytes.Buffer
+        w := multipart.NewWriter(&buf)
+        w.WriteField("name", "upload")
+        for i := 0; i < files; i++ {
+            fw, _ := w.CreateFormFile("file", fmt.Sprintf("f%d.txt", i))
+            fw.Write(bytes.Repeat([]byte("y"), 10+i*100))
+        }
+        w.Close()
+        return buf.String(), map[string][]string{"Content-Type": {w.FormDataContentType()}}
+    }
+
+    body, headers := build(2)
+    resp := getServerTestResponse(s, "POST", "/upload", body, headers, nil)
+    if resp.body != "upload f0.txt:10:10,f1.txt:110:110" {
+        t.Fatalf("unexpected upload response %q", resp.body)
+    }
+    if spilled == "" {
+        t.Fatalf("expected large file to spill to a temp file")
+    }
+    if _, err := os.Stat(spilled); !os.IsNotExist(err) {
+        t.Fatalf("expected temp file to be removed after the handler returned")
+    }
+
+    body, headers = build(3)
+    if resp := getServerTestResponse(s, "POST", "/upload", body, headers, nil); resp.statusCode != 413 {
+        t.Fatalf("expected 413 for too many files, got %d", resp.statusCode)
+    }
+
+    //a middleware that reads the body first, as CSRF does
+    s.Group("", func(ctx *Context, next func()) {
+        ctx.BodyParam("name")
+        next()
+    }).Post("/stdlib", func(ctx *Context) string {
+        ctx.Request.ParseMultipartForm(1 << 20)
+        fh := ctx.Request.MultipartForm.File["file"][0]
+        f, err := fh.Open()
+        if err != nil {
+            return err.Error()
+        }
+        defer f.Close()
+        data, _ := ioutil.ReadAll(f)
+        return fh.Filename + ":" + strconv.Itoa(len(data))
+    })
+    body, headers = build(1)
+    if resp := getServerTestResponse(s, "POST", "/stdlib", body, headers, nil); resp.body != "f0.txt:10" {
+        t.Fatalf("expected stdlib form access after ParseForm, got %d %q", resp.statusCode, resp.body)
+    }
+}
+
+func TestParams(t *testing.T) {
+    s := newTestServer()
+    s.Post("/params", func(ctx *Context) string {
+        return fmt.Sprintf("%v %v %v %d %d %v %v %q",
+            ctx.ParamValues("a"), ctx.QueryValues("a"), ctx.BodyValues("a"),
+            ctx.ParamInt("page", 1), ctx.ParamInt("size", 20), ctx.ParamBool("verbose", false),
+            ctx.ParamFloat("ratio", 0), ctx.Params["a"])
+    })
+    form := map[string][]string{"Content-Type": {"application/x-www-form-urlencoded"}}
+    resp := getServerTestResponse(s, "POST", "/params?a=1&a=2&page=3&size=x&verbose", "a=body&ratio=0.5", form, nil)
+    if resp.body != `[body 1 2] [1 2] [body] 3 20 true 0.5 "body"` {
+        t.Fatalf("unexpected params %q", resp.body)
+    }
+
+    //the body of a route without a context is not read
+    var body *strings.Reader
+    s.Post("/noctx", func() string { return strconv.Itoa(body.Len()) })
+    req := buildTestRequest("POST", "/noctx", "a=b", form, nil)
+    body = strings.NewReader("a=b")
+    req.Body = ioutil.NopCloser(body)
+    var buf bytes.Buffer
+    s.Process(&scgiConn{req: req, headers: map[string][]string{}, fd: &ioBuffer{output: &buf}}, req)
+    if resp := buildTestResponse(&buf); resp.body != "3" {
+        t.Fatalf("expected body to be left unread, got %q", resp.body)
+    }
+
+    s.Post("/bad", func(ctx *Context) string {
+        if err := ctx.ParseForm(); err != nil {
+            return "error"
+        }
+        return "ok"
+    })
+    if resp := getServerTestResponse(s, "POST", "/bad", "a=%zz", form, nil); resp.body != "error" {
+        t.Fatalf("expected parse error to reach the handler, got %q", resp.body)
+    }
+}
+
+func TestMultipartReader(t *testing.T) {
+    png := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 600)...)
+    var buf bytes.Buffer
+    w := multipart.NewWriter(&buf)
+    w.WriteField("title", "holiday")
+    fw, _ := w.CreateFormFile("image", "a.png")
+    fw.Write(png)
+    fw, _ = w.CreateFormFile("image", "b.txt")
+    fw.Write([]byte("plain text"))
+    w.Close()
+    headers := map[string][]string{"Content-Type": {w.FormDataContentType()}}
+
+    s := newTestServer()
+    var maxPart int64
+    var progress int64
+    s.Post("/stream", func(ctx *Context) string {
+        reader, err := ctx.MultipartReader()
+        if err != nil {
+            return err.Error()
+        }
+        reader.MaxPartSize = maxPart
+        reader.AllowedTypes = []string{"image/*"}
+        reader.Progress = func(part *UploadPart, received int64, total int64) { progress = received }
+        var out []string
+        for {
+            part, err := reader.NextPart()
+            if err == io.EOF {
+                break
+            } else if err != nil {
+                return err.Error()
+            }
+            n, err := io.Copy(ioutil.Discard, part)
+            if err != nil {
+                out = append(out, part.FileName+" "+err.Error())
+                continue
+            }
+            out = append(out, fmt.Sprintf("%s %s %d %s", part.FormName, part.ContentType, n, part.SHA256()))
+        }
+        return strings.Join(out, "\n")
+    })
+
+    sum := sha256.Sum256(png)
+    expected := []string{
+        "title text/plain; charset=utf-8 7 " + fmt.Sprintf("%x", sha256.Sum256([]byte("holiday"))),
+        "image image/png 608 " + hex.EncodeToString(sum[:]),
+        "b.txt " + ErrPartType.Error(),
+    }
+    resp := getServerTestResponse(s, "POST", "/stream", buf.String(), headers, nil)
+    if resp.body != strings.Join(expected, "\n") {
+        t.Fatalf("unexpected stream result %q", resp.body)
+    }
+    if progress == 0 {
+        t.Fatalf("expected progress to be reported")
+    }
+
+    maxPart = 100
+    resp = getServerTestResponse(s, "POST", "/stream", buf.String(), headers, nil)
+    if !strings.Contains(resp.body, "a.png "+ErrPartTooLarge.Error()) {
+        t.Fatalf("expected oversized part to be rejected, got %q", resp.body)
+    }
+}
+
+func TestTus(t *testing.T) {
+    dir, err := ioutil.TempDir("", "web-tus-test")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    store, err := NewTusDiskStore(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var completed string
+    var completions int
+    var hookErr error
+    h := NewTusHandler(store)
+    h.MaxSize = 1024
+    h.OnComplete = func(ctx *Context, upload *TusUpload, file io.Reader) error {
+        if hookErr != nil {
+            return hookErr
+        }
+        data, _ := ioutil.ReadAll(file)
+        completed = upload.Metadata["filename"] + ":" + string(data)
+        completions++
+        return nil
+    }
+    s := newTestServer()
+    s.Tus("/files", h)
+
+    tus := func(method, path, body string, headers map[string]string) *testResponse {
+        hdr := map[string][]string{"Tus-Resumable": {"1.0.0"}}
+        for k, v := range headers {
+            hdr[k] = []string{v}
+        }
+        req := buildTestRequest(method, path, body, hdr, nil)
+        req.ContentLength = int64(len(body))
+        var buf bytes.Buffer
+        s.Process(&scgiConn{req: req, headers: map[string][]string{}, fd: &ioBuffer{output: &buf}}, req)
+        return buildTestResponse(&buf)
+    }
+
+    resp := tus("OPTIONS", "/files", "", nil)
+    if resp.statusCode != 204 || !strings.Contains(resp.headers["Tus-Extension"][0], "checksum") {
+        t.Fatalf("unexpected OPTIONS response %d %v", resp.statusCode, resp.headers)
+    }
+    if resp := tus("POST", "/files", "", map[string]string{"Upload-Length": "2048"}); resp.statusCode != 413 {
+        t.Fatalf("expected 413 for oversized upload, got %d", resp.statusCode)
+    }
+    resp = tus("POST", "/files", "", map[string]string{
+        "Upload-Length":   "11",
+        "Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("hello.txt")),
+    })
+    if resp.statusCode != 201 {
+        t.Fatalf("expected 201 on creation, got %d %q", resp.statusCode, resp.body)
+    }
+    location := resp.headers["Location"][0]
+
+    patch := func(offset, body string, extra map[string]string) *testResponse {
+        headers := map[string]string{"Content-Type": "application/offset+octet-stream", "Upload-Offset": offset}
+        for k, v := range extra {
+            headers[k] = v
+        }
+        return tus("PATCH", location, body, headers)
+    }
+    if resp := patch("0", "hello", nil); resp.statusCode != 204 || resp.headers["Upload-Offset"][0] != "5" {
+        t.Fatalf("unexpected PATCH response %d %v", resp.statusCode, resp.headers)
+    }
+    if resp := patch("0", "hello", nil); resp.statusCode != 409 {
+        t.Fatalf("expected 409 for wrong offset, got %d", resp.statusCode)
+    }
+    bad := map[string]string{"Upload-Checksum": "sha1 " + base64.StdEncoding.EncodeToString(make([]byte, 20))}
+    if resp := patch("5", " world", bad); resp.statusCode != 460 {
+        t.Fatalf("expected 460 for checksum mismatch, got %d", resp.statusCode)
+    }
+    if resp := tus("HEAD", location, "", nil); resp.headers["Upload-Offset"][0] != "5" || resp.headers["Upload-Length"][0] != "11" {
+        t.Fatalf("expected mismatched chunk to be discarded, got %v", resp.headers)
+    }
+    //a connection that drops in the middle of a chunk with a checksum
+    req := buildTestRequest("PATCH", location, "", map[string][]string{
+        "Tus-Resumable":   {"1.0.0"},
+        "Content-Type":    {"application/offset+octet-stream"},
+        "Upload-Offset":   {"5"},
+        "Upload-Checksum": {bad["Upload-Checksum"]},
+    }, nil)
+    req.Body = ioutil.NopCloser(io.MultiReader(strings.NewReader(" wo"), iotest.ErrReader(errors.New("connection reset"))))
+    var buf bytes.Buffer
+    s.Process(&scgiConn{req: req, headers: map[string][]string{}, fd: &ioBuffer{output: &buf}}, req)
+    if resp := buildTestResponse(&buf); resp.statusCode != 500 || resp.headers["Upload-Offset"][0] != "5" {
+        t.Fatalf("expected unverified partial chunk to be discarded, got %d %v", resp.statusCode, resp.headers)
+    }
+    if resp := tus("HEAD", location, "", nil); resp.headers["Upload-Offset"][0] != "5" {
+        t.Fatalf("expected unverified partial chunk to be discarded, got %v", resp.headers)
+    }
+    sum := sha1.Sum([]byte(" world"))
+    good := map[string]string{"Upload-Checksum": "sha1 " + base64.StdEncoding.EncodeToString(sum[:])}
+    hookErr = errors.New("storage unavailable")
+    if resp := patch("5", " world", good); resp.statusCode != 500 {
+        t.Fatalf("expected failing completion hook to fail the request, got %d %q", resp.statusCode, resp.body)
+    }
+    hookErr = nil
+    if resp := patch("11", "", nil); resp.statusCode != 204 || resp.headers["Upload-Offset"][0] != "11" {
+        t.Fatalf("unexpected retried final PATCH response %d %q", resp.statusCode, resp.body)
+    }
+    if completed != "hello.txt:hello world" {
+        t.Fatalf("expected completion hook to receive the file, got %q", completed)
+    }
+    if resp := patch("11", "", nil); resp.statusCode != 204 || resp.headers["Upload-Offset"][0] != "11" || completions != 1 {
+        t.Fatalf("expected retried final PATCH to succeed without completing again, got %d, %d completions", resp.statusCode, completions)
+    }
+    if resp := tus("POST", "/files", "", map[string]string{"Upload-Length": "0"}); resp.statusCode != 201 || completions != 2 {
+        t.Fatalf("expected empty upload to complete on creation, got %d, %d completions", resp.statusCode, completions)
+    }
+
+    if resp := tus("DELETE", location, "", nil); resp.statusCode != 204 {
+        t.Fatalf("expected 204 on termination, got %d", resp.statusCode)
+    }
+    if resp := tus("HEAD", location, "", nil); resp.statusCode != 404 {
+        t.Fatalf("expected 404 after termination, got %d", resp.statusCode)
+    }
+
+    h.Expiration = time.Nanosecond
+    resp = tus("POST", "/files", "", map[string]string{"Upload-Length": "5"})
+    time.Sleep(time.Millisecond)
+    //the upload may already have been removed by the background sweep
+    if resp := tus("HEAD", resp.headers["Location"][0], "", nil); resp.statusCode != 410 && resp.statusCode != 404 {
+        t.Fatalf("expected expired upload to be gone, got %d", resp.statusCode)
+    }
+    resp = tus("POST", "/files", "", map[string]string{"Upload-Length": "0"})
+    time.Sleep(time.Millisecond)
+    if resp := tus("HEAD", resp.headers["Location"][0], "", nil); resp.statusCode != 410 && resp.statusCode != 404 {
+        t.Fatalf("expected finished upload to expire too, got %d", resp.statusCode)
+    }
+
+    req = buildTestRequest("HEAD", location, "", nil, nil)
+    buf.Reset()
+    s.Process(&scgiConn{req: req, headers: map[string][]string{}, fd: &ioBuffer{output: &buf}}, req)
+    if resp := buildTestResponse(&buf); resp.statusCode != 412 {
+        t.Fatalf("expected 412 without Tus-Resumable, got %d", resp.statusCode)
+    }
+}
+
+func TestStaticFS(t *testing.T) {
+    dir, err := ioutil.TempDir("", "web-static-test")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    ioutil.WriteFile(filepath.Join(dir, "app.js"), []byte("disk"), 0644)
+    ioutil.WriteFile(filepath.Join(dir, "disk.txt"), []byte("disk only"), 0644)
+
+    s := newTestServer()
+    s.Config.StaticDir = dir
+    s.Config.StaticFS = []fs.FS{
+        fstest.MapFS{"app.js": {Data: []byte("embedded")}},
+        fstest.MapFS{"app.js": {Data: []byte("lower")}, "css/site.css": {Data: []byte("body{}")}},
+    }
+    for path, expected := range map[string]string{
+        "/app.js":       "embedded",
+        "/css/site.css": "body{}",
+        "/disk.txt":     "disk only",
+    } {
+        resp := getServerTestResponse(s, "GET", path, "", nil, nil)
+        if resp.statusCode != 200 || resp.body != expected {
+            t.Fatalf("%s: expected %q, got %d %q", path, expected, resp.statusCode, resp.body)
+        }
+    }
+    if resp := getServerTestResponse(s, "GET", "/css", "", nil, nil); resp.statusCode != 404 {
+        t.Fatalf("expected 404 for directory, got %d", resp.statusCode)
+    }
+}
+
+func TestStaticMounts(t *testing.T) {
+    s := newTestServer()
+    s.Config.NoDefaultStaticDirs = true
+    s.Static("/assets", ".")
+    s.StaticFS("/assets/img/", fstest.MapFS{"logo.svg": {Data: []byte("<svg/>")}})
+    s.StaticFS("/", fstest.MapFS{"robots.txt": {Data: []byte("robots")}, "page": {Data: []byte("static page")}, "docs/index.html": {Data: []byte("docs")}})
+    s.Get("/page", func() string { return "route page" })
+
+    for path, expected := range map[string]string{
+        "/assets/img/logo.svg": "<svg/>",
+        "/robots.txt":          "robots",
+        "/page":                "static page",
+        "/docs/":               "docs",
+    } {
+        resp := getServerTestResponse(s, "GET", path, "", nil, nil)
+        if resp.statusCode != 200 || resp.body != expected {
+            t.Fatalf("%s: expected %q, got %d %q", path, expected, resp.statusCode, resp.body)
+        }
+    }
+    resp := getServerTestResponse(s, "GET", "/assets/web.go", "", nil, nil)
+    if resp.statusCode != 200 || !strings.HasPrefix(resp.body, "// Package web") {
+        t.Fatalf("expected mounted directory to be served, got %d", resp.statusCode)
+    }
+    if resp := getServerTestResponse(s, "GET", "/assetsweb.go", "", nil, nil); resp.statusCode != 404 {
+        t.Fatalf("expected mount to apply only under its prefix, got %d", resp.statusCode)
+    }
+    if resp := getServerTestResponse(s, "GET", "/web.go", "", nil, nil); resp.statusCode != 404 {
+        t.Fatalf("expected mounted file to be unavailable at the root, got %d", resp.statusCode)
+    }
+
+    s.Config.RoutesBeforeStatic = true
+    if resp := getServerTestResponse(s, "GET", "/page", "", nil, nil); resp.body != "route page" {
+        t.Fatalf("expected route to take precedence, got %q", resp.body)
+    }
+    if resp := getServerTestResponse(s, "GET", "/robots.txt", "", nil, nil); resp.body != "robots" {
+        t.Fatalf("expected static file after routes, got %q", resp.body)
+    }
+}
+
+func TestStaticCompression(t *testing.T) {
+    js := strings.Repeat("console.log('hello');\n", 100)
+    modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+    s := newTestServer()
+    s.Config.NoDefaultStaticDirs = true
+    s.StaticFS("/", fstest.MapFS{
+        "app.js":    {Data: []byte(js), ModTime: modTime},
+        "app.js.gz": {Data: []byte("gzipped js"), ModTime: modTime},
+        "app.js.br": {Data: []byte("brotli js"), ModTime: modTime},
+        "site.css":  {Data: []byte(strings.Repeat("body { color: red; }\n", 100)), ModTime: modTime},
+        "logo.png":  {Data: bytes.Repeat([]byte{1}, 2048), ModTime: modTime},
+    })
+
+    get := func(path string, headers map[string][]string) *testResponse {
+        return getServerTestResponse(s, "GET", path, "", headers, nil)
+    }
+    tests := []struct {
+        path, accept, encoding, body string
+    }{
+        {"/app.js", "gzip, deflate, br", "br", "brotli js"},
+        {"/app.js", "gzip;q=1.0, br;q=0.5", "gzip", "gzipped js"},
+        {"/app.js", "identity", "", js},
+        {"/app.js", "*", "br", "brotli js"},
+        {"/app.js", "br;q=0, gzip", "gzip", "gzipped js"},
+    }
+    for _, test := range tests {
+        resp := get(test.path, map[string][]string{"Accept-Encoding": {test.accept}})
+        if enc := resp.headers["Content-Encoding"]; (test.encoding == "" && enc != nil) || (test.encoding != "" && (enc == nil || enc[0] != test.encoding)) {
+            t.Fatalf("%s with %q: expected encoding %q, got %v", test.path, test.accept, test.encoding, enc)
+        }
+        if resp.body != test.body {
+            t.Fatalf("%s with %q: unexpected body %q", test.path, test.accept, resp.body)
+        }
+        if resp.headers["Vary"] == nil || resp.headers["Vary"][0] != "Accept-Encoding" {
+            t.Fatalf("expected Vary: Accept-Encoding, got %v", resp.headers["Vary"])
+        }
+        if !strings.HasPrefix(resp.headers["Content-Type"][0], "text/javascript") {
+            t.Fatalf("expected content type of the original file, got %v", resp.headers["Content-Type"])
+        }
+    }
+
+    resp := get("/app.js", map[string][]string{"Accept-Encoding": {"gzip"}, "Range": {"bytes=0-5"}})
+    if resp.statusCode != 206 || resp.body != "gzippe" {
+        t.Fatalf("expected range of the precompressed file, got %d %q", resp.statusCode, resp.body)
+    }
+    resp = get("/app.js", map[string][]string{"Accept-Encoding": {"br"}, "If-Modified-Since": {webTime(modTime)}})
+    if resp.statusCode != 304 {
+        t.Fatalf("expected 304 for unmodified file, got %d", resp.statusCode)
+    }
+
+    //on the fly compression
+    if resp := get("/site.css", map[string][]string{"Accept-Encoding": {"gzip"}}); resp.headers["Content-Encoding"] != nil {
+        t.Fatalf("expected no compression unless enabled")
+    }
+    s.Config.CompressStatic = true
+    for i := 0; i < 2; i++ {
+        resp = get("/site.css", map[string][]string{"Accept-Encoding": {"gzip"}})
+        if resp.headers["Content-Encoding"] == nil || resp.headers["Content-Encoding"][0] != "gzip" {
+            t.Fatalf("expected gzip encoding, got %v", resp.headers)
+        }
+        zr, err := gzip.NewReader(strings.NewReader(resp.body))
+        if err != nil {
+            t.Fatal(err)
+        }
+        data, _ := ioutil.ReadAll(zr)
+        if !strings.HasPrefix(string(data), "body { color: red; }") {
+            t.Fatalf("unexpected decompressed body %q", data)
+        }
+    }
+    if s.gzipCache.lru.Len() != 1 {
+        t.Fatalf("expected compressed file to be cached")
+    }
+    if resp := get("/logo.png", map[string][]string{"Accept-Encoding": {"gzip"}}); resp.headers["Content-Encoding"] != nil {
+        t.Fatalf("expected images not to be compressed")
+    }
+}
+
+func TestAssetFingerprints(t *testing.T) {
+    s := newTestServer()
+    s.Config.NoDefaultStaticDirs = true
+    s.StaticFS("/assets", fstest.MapFS{"app.js": {Data: []byte("app")}, "img/logo.png": {Data: []byte("logo")}})
+    s.StaticFS("/", fstest.MapFS{"robots.txt": {Data: []byte("robots")}, "site.css": {Data: []byte("css")}})
+    s.CacheControl("/assets/", "public, max-age=600")
+    s.CacheControl("*.css", "no-cache")
+    if err := s.Fingerprint(); err != nil {
+        t.Fatal(err)
+    }
+
+    sum := sha256.Sum256([]byte("app"))
+    hashed := "/assets/app." + hex.EncodeToString(sum[:])[:8] + ".js"
+    if url := s.AssetURL("/assets/app.js"); url != hashed {
+        t.Fatalf("expected %s, got %s", hashed, url)
+    }
+    if url := s.AssetURL("/missing.js"); url != "/missing.js" {
+        t.Fatalf("expected unknown asset to be unchanged, got %s", url)
+    }
+    var buf bytes.Buffer
+    tmpl := template.Must(template.New("").Funcs(s.AssetFuncs()).Parse(`<script src="{{asset "/assets/app.js"}}"></script>`))
+    tmpl.Execute(&buf, nil)
+    if buf.String() != `<script src="`+hashed+`"></script>` {
+        t.Fatalf("unexpected template output %q", buf.String())
+    }
+
+    for path, expected := range map[string][2]string{
+        hashed:                 {"app", immutableCacheControl},
+        "/assets/app.js":       {"app", "public, max-age=600"},
+        "/assets/img/logo.png": {"logo", "public, max-age=600"},
+        "/site.css":            {"css", "no-cache"},
+        "/robots.txt":          {"robots", ""},
+    } {
+        resp := getServerTestResponse(s, "GET", path, "", nil, nil)
+        var cc string
+        if v := resp.headers["Cache-Control"]; v != nil {
+            cc = v[0]
+        }
+        if resp.body != expected[0] || cc != expected[1] {
+            t.Fatalf("%s: expected %q with %q, got %q with %q", path, expected[0], expected[1], resp.body, cc)
+        }
+    }
+}
+
+func TestStaticListingAndFallback(t *testing.T) {
+    s := newTestServer()
+    s.Config.NoDefaultStaticDirs = true
+    files := s.StaticFS("/files", fstest.MapFS{
+        "a.txt":          {Data: []byte("a")},
+        "sub/b.txt":      {Data: []byte("bb")},
+        ".secret":        {Data: []byte("hidden")},
+        "docs/index.htm": {Data: []byte("docs")},
+    })
+    files.DirListing = true
+    app := s.StaticFS("/app", fstest.MapFS{"index.html": {Data: []byte("spa")}, "main.js": {Data: []byte("js")}})
+    app.Fallback = "index.html"
+    s.Get("/app/api/status", func() string { return "ok" })
+
+    resp := getServerTestResponse(s, "GET", "/files/", "", nil, nil)
+    if resp.statusCode != 200 || !strings.Contains(resp.body, `<a href="a.txt">a.txt</a>`) || !strings.Contains(resp.body, `<a href="sub/">sub/</a>`) {
+        t.Fatalf("unexpected listing %d %q", resp.statusCode, resp.body)
+    }
+    if strings.Contains(resp.body, ".secret") {
+        t.Fatalf("expected dotfiles to be hidden from listings")
+    }
+    resp = getServerTestResponse(s, "GET", "/files/sub/", "", map[string][]string{"Accept": {"application/json"}}, nil)
+    var entries []DirEntry
+    if err := json.Unmarshal([]byte(resp.body), &entries); err != nil || len(entries) != 1 || entries[0].Name != "b.txt" || entries[0].Size != 2 {
+        t.Fatalf("unexpected JSON listing %q", resp.body)
+    }
+    if resp := getServerTestResponse(s, "GET", "/files/sub", "", nil, nil); resp.statusCode != 301 || resp.headers["Location"][0] != "/files/sub/" {
+        t.Fatalf("expected redirect to the directory, got %d", resp.statusCode)
+    }
+    if resp := getServerTestResponse(s, "GET", "/files/docs/", "", nil, nil); resp.body != "docs" {
+        t.Fatalf("expected index file instead of a listing, got %q", resp.body)
+    }
+
+    files.ListingTemplate = template.Must(template.New("").Parse(`{{range .Entries}}{{.Name}};{{end}}`))
+    if resp := getServerTestResponse(s, "GET", "/files/sub/", "", nil, nil); resp.body != "b.txt;" {
+        t.Fatalf("expected custom listing template, got %q", resp.body)
+    }
+
+    for path, expected := range map[string]string{
+        "/app/":           "spa",
+        "/app/users/42":   "spa",
+        "/app/main.js":    "js",
+        "/app/api/status": "ok",
+    } {
+        if resp := getServerTestResponse(s, "GET", path, "", nil, nil); resp.statusCode != 200 || resp.body != expected {
+            t.Fatalf("%s: expected %q, got %d %q", path, expected, resp.statusCode, resp.body)
+        }
+    }
+    if resp := getServerTestResponse(s, "GET", "/app/missing.js", "", nil, nil); resp.statusCode != 404 {
+        t.Fatalf("expected 404 for missing asset, got %d", resp.statusCode)
+    }
+    if resp := getServerTestResponse(s, "POST", "/app/users/42", "", nil, nil); resp.statusCode != 404 {
+        t.Fatalf("expected fallback only for GET, got %d", resp.statusCode)
+    }
+}
+
+func TestStaticTraversal(t *testing.T) {
+    base, err := ioutil.TempDir("", "web-traversal-test")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(base)
+    root := filepath.Join(base, "public")
+    os.MkdirAll(filepath.Join(root, ".git"), 0755)
+    os.MkdirAll(filepath.Join(root, ".well-known"), 0755)
+    os.MkdirAll(filepath.Join(root, "css"), 0755)
+    const secret = "top secret"
+    ioutil.WriteFile(filepath.Join(base, "secret.txt"), []byte(secret), 0644)
+    ioutil.WriteFile(filepath.Join(root, "index.txt"), []byte("public"), 0644)
+    ioutil.WriteFile(filepath.Join(root, "css", "site.css"), []byte("css"), 0644)
+    ioutil.WriteFile(filepath.Join(root, ".env"), []byte(secret), 0644)
+    ioutil.WriteFile(filepath.Join(root, ".git", "config"), []byte(secret), 0644)
+    ioutil.WriteFile(filepath.Join(root, ".well-known", "security.txt"), []byte("contact"), 0644)
+    ioutil.WriteFile(filepath.Join(root, "site.css.bak"), []byte(secret), 0644)
+    ioutil.WriteFile(filepath.Join(root, "notes.md"), []byte(secret), 0644)
+    os.Symlink(filepath.Join(base, "secret.txt"), filepath.Join(root, "escape.txt"))
+    os.Symlink(base, filepath.Join(root, "up"))
+    os.Symlink("index.txt", filepath.Join(root, "inside.txt"))
+
+    s := newTestServer()
+    s.Config.StaticDir = root
+    s.Config.StaticDeny = append(DefaultStaticDeny, "*.md")
+    s.Static("/mnt", root).DirListing = true
+
+    allowed := map[string]string{
+        "/index.txt":                "public",
+        "/inside.txt":               "public",
+        "/css/site.css":             "css",
+        "/.well-known/security.txt": "contact",
+        "/mnt/index.txt":            "public",
+    }
+    for path, expected := range allowed {
+        if resp := getServerTestResponse(s, "GET", path, "", nil, nil); resp.statusCode != 200 || resp.body != expected {
+            t.Fatalf("%s: expected %q, got %d %q", path, expected, resp.statusCode, resp.body)
+        }
+    }
+
+    attempts := []string{
+        "/../secret.txt",
+        "/%2e%2e/secret.txt",
+        "/%2E%2E%2Fsecret.txt",
+        "/%252e%252e/secret.txt",
+        "/%252e%252e%252fsecret.txt",
+        "/css/../../secret.txt",
+        "/css/%2e%2e/%2e%2e/secret.txt",
+        "/..%2fsecret.txt",
+        "/..%252fsecret.txt",
+        "/..\\secret.txt",
+        "/%2e%2e%5csecret.txt",
+        "/mnt/../secret.txt",
+        "/mnt/%2e%2e/secret.txt",
+        "/mnt/..%2f..%2fsecret.txt",
+        "/escape.txt",
+        "/up/secret.txt",
+        "/mnt/escape.txt",
+        "/mnt/up/secret.txt",
+        "/.env",
+        "/%2eenv",
+        "/.git/config",
+        "/%2egit/config",
+        "/mnt/.git/config",
+        "/mnt/.git/",
+        "/site.css.bak",
+        "/notes.md",
+        "/mnt/notes.md",
+        "/index.txt%00.md",
+    }
+    for _, path := range attempts {
+        resp := getServerTestResponse(s, "GET", path, "", nil, nil)
+        if resp.statusCode == 200 || strings.Contains(resp.body, secret) {
+            t.Fatalf("%s: expected request to be refused, got %d %q", path, resp.statusCode, resp.body)
+        }
+    }
+
+    resp := getServerTestResponse(s, "GET", "/mnt/", "", nil, nil)
+    for _, hidden := range []string{".env", ".git", "notes.md", "site.css.bak"} {
+        if strings.Contains(resp.body, hidden) {
+            t.Fatalf("expected %s to be hidden from the listing", hidden)
+        }
+    }
+}
+
+func TestStaticFileCache(t *testing.T) {
+    dir, err := ioutil.TempDir("", "web-cache-test")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    file := filepath.Join(dir, "app.js")
+    ioutil.WriteFile(file, []byte("version 1"), 0644)
+    ioutil.WriteFile(filepath.Join(dir, "big.bin"), make([]byte, 200), 0644)
+    ioutil.WriteFile(filepath.Join(dir, "other.txt"), []byte("other"), 0644)
+
+    s := newTestServer()
+    s.Config.StaticDir = dir
+    s.Config.StaticCacheSize = 100
+    s.Config.StaticCachePoll = 10 * time.Millisecond
+
+    resp := getServerTestResponse(s, "GET", "/app.js", "", nil, nil)
+    etag := resp.headers["Etag"]
+    if resp.body != "version 1" || etag == nil {
+        t.Fatalf("unexpected response %q %v", resp.body, resp.headers)
+    }
+    //served from memory even though the file is gone
+    os.Rename(file, file+".moved")
+    if resp := getServerTestResponse(s, "GET", "/app.js", "", nil, nil); resp.body != "version 1" {
+        t.Fatalf("expected cached file, got %d %q", resp.statusCode, resp.body)
+    }
+    if resp := getServerTestResponse(s, "GET", "/app.js", "", map[string][]string{"If-None-Match": etag}, nil); resp.statusCode != 304 {
+        t.Fatalf("expected 304 for cached ETag, got %d", resp.statusCode)
+    }
+    if resp := getServerTestResponse(s, "GET", "/app.js", "", map[string][]string{"Range": {"bytes=0-6"}}, nil); resp.statusCode != 206 || resp.body != "version" {
+        t.Fatalf("expected range of cached file, got %d %q", resp.statusCode, resp.body)
+    }
+    getServerTestResponse(s, "GET", "/big.bin", "", nil, nil)
+    stats := s.StaticCacheStats()
+    if stats.Hits != 3 || stats.Misses != 1 || stats.Files != 1 || stats.Bytes != 9 {
+        t.Fatalf("unexpected cache stats %+v", stats)
+    }
+
+    ioutil.WriteFile(file, []byte("version 2!"), 0644)
+    time.Sleep(100 * time.Millisecond)
+    resp = getServerTestResponse(s, "GET", "/app.js", "", nil, nil)
+    if resp.body != "version 2!" || resp.headers["Etag"][0] == etag[0] {
+        t.Fatalf("expected changed file to be reloaded, got %q", resp.body)
+    }
+
+    //the least recently used file is evicted
+    getServerTestResponse(s, "GET", "/other.txt", "", nil, nil)
+    for i := 0; i < 10; i++ {
+        name := fmt.Sprintf("f%d.txt", i)
+        ioutil.WriteFile(filepath.Join(dir, name), bytes.Repeat([]byte("x"), 20), 0644)
+        getServerTestResponse(s, "GET", "/"+name, "", nil, nil)
+    }
+    if stats := s.StaticCacheStats(); stats.Bytes > 100 || stats.Files != 5 {
+        t.Fatalf("expected cache to stay within its size, got %+v", stats)
+    }
+}
+
+func TestSignedURLs(t *testing.T) {
+    dir, err := ioutil.TempDir("", "web-signed-test")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    report := filepath.Join(dir, "report.pdf")
+    ioutil.WriteFile(report, []byte("%PDF report"), 0644)
+    ioutil.WriteFile(filepath.Join(dir, "x.png"), []byte("<html>not a png</html>"), 0644)
+    ioutil.WriteFile(filepath.Join(dir, "upload"), []byte("<html><script>alert(1)</script>"), 0644)
+
+    s := newTestServer()
+    s.Config.NoDefaultStaticDirs = true
+    s.Get("/files/(.*)", func(ctx *Context, name string) {
+        ctx.SendFile(filepath.Join(dir, filepath.Base(name)))
+    })
+    s.StaticFS("/private", fstest.MapFS{"a b.txt": {Data: []byte("private")}, "pub/secret.txt": {Data: []byte("secret")}}).RequireSignature = true
+    s.StaticFS("/private/pub", fstest.MapFS{"x.txt": {Data: []byte("public")}})
+    s.Group("/download", RequireSignedURL()).Get("/(.*)", func(ctx *Context, name string) string {
+        ctx.Attachment(name)
+        if err := ctx.SendFile(filepath.Join(dir, filepath.Base(name))); err != nil {
+            ctx.NotFound("File not found")
+        }
+        return ""
+    })
+
+    get := func(rawurl string, headers map[string][]string) *testResponse {
+        u, _ := url.Parse(rawurl)
+        req := buildTestRequest("GET", u.RequestURI(), "", headers, nil)
+        req.RemoteAddr = "192.0.2.1:1234"
+        var buf bytes.Buffer
+        s.Process(&scgiConn{req: req, headers: map[string][]string{}, fd: &ioBuffer{output: &buf}}, req)
+        return buildTestResponse(&buf)
+    }
+
+    signed := s.SignURL("/private/a b.txt", time.Minute)
+    if resp := get(signed, nil); resp.statusCode != 200 || resp.body != "private" {
+        t.Fatalf("expected signed URL to be served, got %d %q", resp.statusCode, resp.body)
+    }
+    if resp := get("/private/a%20b.txt", nil); resp.statusCode != 403 {
+        t.Fatalf("expected 403 without signature, got %d", resp.statusCode)
+    }
+    if resp := get(strings.Replace(signed, "expires=", "expires=1", 1), nil); resp.statusCode != 403 {
+        t.Fatalf("expected 403 for tampered expiry, got %d", resp.statusCode)
+    }
+    if resp := get(s.SignURL("/private/a b.txt", -time.Minute), nil); resp.statusCode != 403 || !strings.Contains(resp.body, "expired") {
+        t.Fatalf("expected 403 for expired URL, got %d %q", resp.statusCode, resp.body)
+    }
+    if resp := get(strings.Replace(signed, "a%20b", "other", 1), nil); resp.statusCode != 403 {
+        t.Fatalf("expected signature to cover the path, got %d", resp.statusCode)
+    }
+    if resp := get("/private/pub/x.txt", nil); resp.statusCode != 200 || resp.body != "public" {
+        t.Fatalf("expected nested unsigned mount to be public, got %d %q", resp.statusCode, resp.body)
+    }
+    for i := 0; i < 3; i++ {
+        //the last requests are answered from the file cache
+        if resp := get("/private/pub/secret.txt", nil); resp.statusCode != 403 {
+            t.Fatalf("expected file of the signed mount to need a signature, got %d %q", resp.statusCode, resp.body)
+        }
+        if resp := get(s.SignURL("/private/pub/secret.txt", time.Minute), nil); resp.statusCode != 200 || resp.body != "secret" {
+            t.Fatalf("expected signed file below nested mount, got %d %q", resp.statusCode, resp.body)
+        }
+        s.Config.StaticCacheSize = 1 << 20
+    }
+
+    resp := get(s.SignURLForIP("/download/report.pdf", time.Minute, "192.0.2.1"), nil)
+    if resp.statusCode != 200 || resp.body != "%PDF report" || resp.headers["Content-Type"][0] != "application/pdf" {
+        t.Fatalf("unexpected download %d %q %v", resp.statusCode, resp.body, resp.headers)
+    }
+    if cd := resp.headers["Content-Disposition"][0]; cd != `attachment; filename="report.pdf"` {
+        t.Fatalf("unexpected Content-Disposition %q", cd)
+    }
+    if resp := get(s.SignURLForIP("/download/report.pdf", time.Minute, "192.0.2.2"), nil); resp.statusCode != 403 {
+        t.Fatalf("expected URL bound to another IP to be refused, got %d", resp.statusCode)
+    }
+    for name, expected := range map[string]string{"x.png": "image/png", "upload": "application/octet-stream"} {
+        if resp := get("/files/"+name, nil); resp.statusCode != 200 || resp.headers["Content-Type"][0] != expected {
+            t.Fatalf("%s: expected Content-Type %s, got %d %v", name, expected, resp.statusCode, resp.headers["Content-Type"])
+        }
+    }
+    resp = get(s.SignURL("/download/report.pdf", time.Minute), map[string][]string{"Range": {"bytes=1-3"}})
+    if resp.statusCode != 206 || resp.body != "PDF" {
+        t.Fatalf("expected range of sent file, got %d %q", resp.statusCode, resp.body)
+    }
+
+    for name, expected := range map[string]string{
+        "plain.txt":       `attachment; filename="plain.txt"`,
+        `say "hi".txt`:    `attachment; filename="say _hi_.txt"`,
+        "résumé.pdf":      `attachment; filename="r_sum_.pdf"; filename*=UTF-8''r%C3%A9sum%C3%A9.pdf`,
+        "отчёт 2024.xlsx": `attachment; filename="_____ 2024.xlsx"; filename*=UTF-8''%D0%BE%D1%82%D1%87%D1%91%D1%82%202024.xlsx`,
+    } {
+        if cd := contentDisposition("attachment", name); cd != expected {
+            t.Fatalf("%s: expected %q, got %q", name, expected, cd)
+        }
+    }
+}
+
+func TestETag(t *testing.T) {
+    s := newTestServer()
+    lastMod := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+    pages := s.Group("/pages", ETag(false))
+    pages.Get("/(.*)", func(name string) string { return "page " + name })
+    s.Group("/weak", ETag(true)).Get("/(.*)", func(name string) string { return "weak " + name })
+    s.Group("/docs").Match("PUT", "/(.*)", func(ctx *Context, name string) string {
+        if !ctx.CheckModified(`"v1"`, lastMod) {
+            return ""
+        }
+        return "updated " + name
+    })
+    s.Get("/docs/(.*)", func(ctx *Context, name string) string {
+        if !ctx.CheckModified("v1", lastMod) {
+            return ""
+        }
+        return "doc " + name
+    })
+
+    resp := getServerTestResponse(s, "GET", "/pages/a", "", nil, nil)
+    etag := resp.headers["Etag"][0]
+    if resp.statusCode != 200 || resp.body != "page a" || !strings.HasPrefix(etag, `"`) {
+        t.Fatalf("unexpected response %d %q %q", resp.statusCode, resp.body, etag)
+    }
+    if other := getServerTestResponse(s, "GET", "/pages/b", "", nil, nil).headers["Etag"][0]; other == etag {
+        t.Fatalf("expected different bodies to have different ETags")
+    }
+    resp = getServerTestResponse(s, "GET", "/pages/a", "", map[string][]string{"If-None-Match": {`"x", ` + etag}}, nil)
+    if resp.statusCode != 304 || resp.body != "" {
+        t.Fatalf("expected 304, got %d %q", resp.statusCode, resp.body)
+    }
+    if resp := getServerTestResponse(s, "GET", "/pages/a", "", map[string][]string{"If-Match": {`"x"`}}, nil); resp.statusCode != 412 {
+        t.Fatalf("expected 412 for failed If-Match, got %d", resp.statusCode)
+    }
+
+    weak := getServerTestResponse(s, "GET", "/weak/a", "", nil, nil).headers["Etag"][0]
+    if !strings.HasPrefix(weak, `W/"`) {
+        t.Fatalf("expected weak ETag, got %q", weak)
+    }
+    if resp := getServerTestResponse(s, "GET", "/weak/a", "", map[string][]string{"If-None-Match": {strings.TrimPrefix(weak, "W/")}}, nil); resp.statusCode != 304 {
+        t.Fatalf("expected weak comparison for If-None-Match, got %d", resp.statusCode)
+    }
+    if resp := getServerTestResponse(s, "GET", "/weak/a", "", map[string][]string{"If-Match": {weak}}, nil); resp.statusCode != 412 {
+        t.Fatalf("expected strong comparison for If-Match, got %d", resp.statusCode)
+    }
+
+    resp = getServerTestResponse(s, "GET", "/docs/a", "", nil, nil)
+    if resp.statusCode != 200 || resp.headers["Etag"][0] != `"v1"` || resp.headers["Last-Modified"][0] != webTime(lastMod) {
+        t.Fatalf("unexpected response %d %v", resp.statusCode, resp.headers)
+    }
+    tests := []struct {
+        method   string
+        headers  map[string][]string
+        expected int
+    }{
+        {"GET", map[string][]string{"If-Modified-Since": {webTime(lastMod)}}, 304},
+        {"GET", map[string][]string{"If-Modified-Since": {webTime(lastMod.Add(-time.Hour))}}, 200},
+        {"GET", map[string][]string{"If-None-Match": {`"v0"`}, "If-Modified-Since": {webTime(lastMod)}}, 200},
+        {"PUT", map[string][]string{"If-Match": {`"v1"`}}, 200},
+        {"PUT", map[string][]string{"If-Match": {`"v0"`}}, 412},
+        {"PUT", map[string][]string{"If-Match": {"*"}}, 200},
+        {"PUT", map[string][]string{"If-None-Match": {"*"}}, 412},
+        {"PUT", map[string][]string{"If-Unmodified-Since": {webTime(lastMod)}}, 200},
+        {"PUT", map[string][]string{"If-Unmodified-Since": {webTime(lastMod.Add(-time.Hour))}}, 412},
+    }
+    for _, test := range tests {
+        resp := getServerTestResponse(s, test.method, "/docs/a", "", test.headers, nil)
+        if resp.statusCode != test.expected {
+            t.Fatalf("%s %v: expected %d, got %d", test.method, test.headers, test.expected, resp.statusCode)
+        }
+    }
+}